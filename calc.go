@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// errOverflow is returned when an arithmetic expression's result doesn't fit in an int64.
+var errOverflow = errors.New("integer overflow")
+
+// errNotAllowed is returned when an arithmetic expression refers to a name that -expand-only doesn't allow.
+var errNotAllowed = errors.New("reference not allowed")
+
+// expandArithmetic writes the result of the $(( EXPR )) expression at the start of s to b, returning the number of
+// bytes of s it consumed. References in EXPR are expanded first, and names in it are resolved as references are, so
+// their values must be integers. An expression that can't be evaluated is logged and written as-is, as is one that
+// refers to a name not allowed by -expand-only (without logging). An expression whose result overflows is fatal.
+func (e *expander) expandArithmetic(b *bytes.Buffer, key, s string) int {
+	end := arithmeticEnd(s[3:])
+	if end == -1 { // Unterminated -- leave as-is
+		b.WriteByte('$')
+		return 1
+	}
+	end += 3
+
+	p := arithParser{s: e.expand(key, s[3:end]), lookup: func(name string) (int64, error) {
+		return e.lookupInt(key, name)
+	}}
+	n, err := p.eval()
+	switch err {
+	case nil:
+		b.WriteString(strconv.FormatInt(n, 10))
+	case errNotAllowed:
+		b.WriteString(s[:end+2])
+	case errOverflow:
+		fatal(exitDataErr, "error calculating ", strconv.Quote(s[:end+2]), " in ", key, ": ", err)
+	default:
+		log("error calculating ", strconv.Quote(s[:end+2]), " in ", key, ": ", err)
+		b.WriteString(s[:end+2])
+	}
+	return end + 2
+}
+
+// lookupInt returns the integer value of the name referenced by an arithmetic expression in the value of key.
+func (e *expander) lookupInt(key, name string) (int64, error) {
+	if !e.allowed(name) {
+		return 0, errNotAllowed
+	}
+	if i, ok := e.active[name]; ok && i == 0 {
+		return 0, fmt.Errorf("cycle in reference to %q", name)
+	}
+	v, ok := e.resolve(name)
+	if !ok {
+		return 0, fmt.Errorf("%q is not set", name)
+	}
+	v = strings.TrimSpace(v)
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an integer: %q", name, v)
+	}
+	return n, nil
+}
+
+// arithmeticEnd returns the index of the )) closing an arithmetic expression in s, skipping balanced parentheses within
+// the expression, or -1 if the expression is unterminated.
+func arithmeticEnd(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			} else if strings.HasPrefix(s[i:], "))") {
+				return i
+			} else {
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// eval evaluates the whole expression.
+func (p *arithParser) eval() (int64, error) {
+	n, err := p.sum()
+	if err != nil {
+		return 0, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return 0, fmt.Errorf("unexpected %q", p.s[p.pos:])
+	}
+	return n, nil
+}
+
+// arithParser is a recursive descent parser for arithmetic expressions, evaluating them as they're parsed.
+type arithParser struct {
+	s      string
+	pos    int
+	lookup func(name string) (int64, error) // Returns the value of a name in the expression.
+}
+
+func (p *arithParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// next skips whitespace and returns the next byte, or 0 at the end of the expression.
+func (p *arithParser) next() byte {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// sum parses terms separated by + or -.
+func (p *arithParser) sum() (int64, error) {
+	n, err := p.product()
+	for err == nil {
+		op := p.next()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+
+		var m int64
+		if m, err = p.product(); err != nil {
+			break
+		}
+		if op == '+' {
+			n, err = addInt(n, m)
+		} else {
+			n, err = subInt(n, m)
+		}
+	}
+	return n, err
+}
+
+// product parses factors separated by * or /.
+func (p *arithParser) product() (int64, error) {
+	n, err := p.factor()
+	for err == nil {
+		op := p.next()
+		if op != '*' && op != '/' {
+			break
+		}
+		p.pos++
+
+		var m int64
+		if m, err = p.factor(); err != nil {
+			break
+		}
+		if op == '*' {
+			n, err = mulInt(n, m)
+		} else if m == 0 {
+			err = errors.New("division by zero")
+		} else if n == math.MinInt64 && m == -1 {
+			err = errOverflow
+		} else {
+			n /= m
+		}
+	}
+	return n, err
+}
+
+// factor parses a number, name, negated factor, or parenthesized expression.
+func (p *arithParser) factor() (int64, error) {
+	switch c := p.next(); {
+	case c == '-' || c == '+':
+		p.pos++
+		n, err := p.factor()
+		if c == '-' && err == nil {
+			n, err = subInt(0, n)
+		}
+		return n, err
+	case c == '(':
+		p.pos++
+		n, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if p.next() != ')' {
+			return 0, errors.New("expected )")
+		}
+		p.pos++
+		return n, nil
+	case isDigit(c):
+		start := p.pos
+		for p.pos < len(p.s) && isDigit(p.s[p.pos]) {
+			p.pos++
+		}
+		n, err := strconv.ParseInt(p.s[start:p.pos], 10, 64)
+		if err != nil {
+			return 0, errOverflow // Only digits were parsed, so the number is out of range
+		}
+		return n, nil
+	case isNameStart(c):
+		start := p.pos
+		for p.pos < len(p.s) && (isNameByte(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		return p.lookup(p.s[start:p.pos])
+	case c == 0:
+		return 0, errors.New("unexpected end of expression")
+	default:
+		return 0, fmt.Errorf("unexpected %q", c)
+	}
+}
+
+// addInt returns a+b, or errOverflow if the sum doesn't fit in an int64.
+func addInt(a, b int64) (int64, error) {
+	if c := a + b; (c > a) == (b > 0) {
+		return c, nil
+	}
+	return 0, errOverflow
+}
+
+// subInt returns a-b, or errOverflow if the difference doesn't fit in an int64.
+func subInt(a, b int64) (int64, error) {
+	if c := a - b; (c < a) == (b > 0) {
+		return c, nil
+	}
+	return 0, errOverflow
+}
+
+// mulInt returns a*b, or errOverflow if the product doesn't fit in an int64.
+func mulInt(a, b int64) (int64, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+	if c := a * b; c/b == a && !(b == -1 && a == math.MinInt64) {
+		return c, nil
+	}
+	return 0, errOverflow
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// importDotenvFile loads KEY=value lines from a dotenv file at path into dst, with keys cased as by -c. Lines may be
+// prefixed with "export", and blank lines and lines beginning with # are skipped.
+//
+// Values may be unquoted, in which case they run to the end of the line (less any trailing whitespace-separated
+// #comment), double-quoted with Go escapes, or single-quoted. Single-quoted values are taken literally and are not
+// subject to expansion. Quoted values may span multiple lines.
+func importDotenvFile(dst map[string][]string, path string, dec *configReader) {
+	b, err := dec.readInput(path)
+	if err != nil {
+		dec.fail(exitFailure, "error reading <", path, ">: ", err)
+		return
+	}
+	if dec.crlf {
+		b = foldCRLF(b)
+	}
+
+	p := dotenvParser{s: string(b), line: 1, source: path, casing: dec.casing}
+	if err = p.parse(dst); err != nil {
+		dec.fail(exitDataErr, "error parsing dotenv ", path, ": line ", p.line, ": ", err)
+	}
+}
+
+type dotenvParser struct {
+	s      string
+	line   int
+	source string
+	casing keyCasing
+}
+
+func (p *dotenvParser) parse(dst map[string][]string) error {
+	for {
+		p.s = strings.TrimLeft(p.s, " \t\r")
+		if p.s == "" {
+			return nil
+		}
+
+		switch p.s[0] {
+		case '\n':
+			p.s = p.s[1:]
+			p.line++
+			continue
+		case '#':
+			p.skipLine()
+			continue
+		}
+
+		eq := strings.IndexAny(p.s, "=\n")
+		if eq == -1 || p.s[eq] != '=' {
+			return errors.New("expected KEY=value")
+		}
+
+		key := strings.TrimSpace(p.s[:eq])
+		if strings.HasPrefix(key, "export") {
+			if rest := strings.TrimLeft(key[len("export"):], " \t"); len(rest) < len(key)-len("export") {
+				key = rest
+			}
+		}
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("invalid key %q", key)
+		}
+
+		p.s = strings.TrimLeft(p.s[eq+1:], " \t")
+		literal := strings.HasPrefix(p.s, "'")
+		value, err := p.value()
+		if err != nil {
+			return err
+		}
+		if literal {
+			addLiteralValue(dst, p.casing.apply(key), value, p.source)
+		} else {
+			addValue(dst, p.casing.apply(key), value, p.source)
+		}
+	}
+}
+
+func (p *dotenvParser) skipLine() {
+	if i := strings.IndexByte(p.s, '\n'); i != -1 {
+		p.s = p.s[i+1:]
+		p.line++
+	} else {
+		p.s = ""
+	}
+}
+
+func (p *dotenvParser) value() (string, error) {
+	if p.s == "" {
+		return "", nil
+	}
+
+	var value string
+	switch p.s[0] {
+	case '"':
+		var b strings.Builder
+		p.s = p.s[1:]
+		for {
+			if p.s == "" {
+				return "", errors.New("unterminated double-quoted value")
+			} else if p.s[0] == '"' {
+				break
+			} else if p.s[0] == '\n' {
+				p.line++
+			}
+
+			r, _, tail, err := strconv.UnquoteChar(p.s, '"')
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in double-quoted value: %v", err)
+			}
+			b.WriteRune(r)
+			p.s = tail
+		}
+		p.s = p.s[1:]
+		value = b.String()
+	case '\'':
+		end := strings.IndexByte(p.s[1:], '\'')
+		if end == -1 {
+			return "", errors.New("unterminated single-quoted value")
+		}
+		value = p.s[1 : end+1]
+		p.line += strings.Count(value, "\n")
+		p.s = p.s[end+2:]
+		// Single-quoted values are literal, so escape them from expansion
+		value = escapeValue(value)
+	default:
+		end := strings.IndexByte(p.s, '\n')
+		if end == -1 {
+			end = len(p.s)
+		}
+		value = stripComment(p.s[:end])
+		p.s = p.s[end:]
+		return strings.TrimSpace(value), nil
+	}
+
+	// Only whitespace or a comment may follow a quoted value
+	end := strings.IndexByte(p.s, '\n')
+	if end == -1 {
+		end = len(p.s)
+	}
+	if rest := strings.TrimSpace(p.s[:end]); rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("unexpected %q after quoted value", rest)
+	}
+	p.s = p.s[end:]
+	return value, nil
+}
+
+// stripComment removes a trailing #comment from s, provided the # is preceded by whitespace.
+func stripComment(s string) string {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '#' && (s[i-1] == ' ' || s[i-1] == '\t') {
+			return s[:i]
+		}
+	}
+	return s
+}
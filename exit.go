@@ -0,0 +1,21 @@
+package main
+
+// Exit statuses of binit. If binit runs a command with -w, it otherwise exits with the command's exit status.
+const (
+	// exitFailure is a general error, such as failing to read a file under -strict or to change directories.
+	exitFailure = 1
+	// exitUsage is an error in how binit was invoked: an invalid flag, or a variable that's required but not set,
+	// fails its check, has an invalid name under -posix -strict, or is unset when referenced by ${NAME:?WORD}.
+	exitUsage = 64
+	// exitDataErr is a file that couldn't be parsed, or a template that couldn't be rendered, under -strict, or an exec
+	// setting that couldn't be split into words.
+	exitDataErr = 65
+	// exitLocked is a -lock file that's locked by another process, without -lock-wait.
+	exitLocked = 75
+	// exitTimeout is a command killed by binit for exceeding its -run-timeout, as with timeout(1).
+	exitTimeout = 124
+	// exitCannotExec is a command that was found but couldn't be run.
+	exitCannotExec = 126
+	// exitNotFound is a command that couldn't be found.
+	exitNotFound = 127
+)
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// expandValues resolves ${NAME} and $NAME references in the values of src, in place. Names are looked up in src first
+// and fall back to env if src doesn't hold them. $$ expands to a literal $. If winExpand is set, %NAME% references are
+// resolved as well, and %% expands to a literal %.
+//
+// A reference to a key whose expansion is already in progress resolves to the values preceding the one being expanded,
+// so that PATH=${PATH}:/opt/bin extends whatever PATH was set before it. If no such values exist, the reference is a
+// cycle: it is logged and expands to an empty string, as do references that cannot be resolved at all.
+//
+// If allow is not nil, only references to names matching one of its patterns are expanded. Other references are left
+// as written. If calc is set, $(( EXPR )) arithmetic is evaluated as well (see expandArithmetic).
+func expandValues(src map[string][]string, env map[string]string, j *joiner, allow []keyPattern, calc bool) {
+	e := expander{
+		src:    src,
+		env:    env,
+		joiner: j,
+		allow:  allow,
+		calc:   calc,
+		active: map[string]int{},
+		done:   map[string]bool{},
+	}
+	for k := range src {
+		e.expandKey(k)
+	}
+}
+
+// winExpand controls whether Windows-style %NAME% references are expanded (-winexpand).
+var winExpand bool
+
+// escapeEnv returns a copy of env with each value escaped by escapeValue.
+func escapeEnv(env map[string]string) map[string]string {
+	escaped := make(map[string]string, len(env))
+	for k, v := range env {
+		escaped[k] = escapeValue(v)
+	}
+	return escaped
+}
+
+// escapeValue returns s with every $, and every % if winExpand is set, doubled, so that it comes out of expandValues
+// verbatim.
+func escapeValue(s string) string {
+	s = strings.Replace(s, "$", "$$", -1)
+	if winExpand {
+		s = strings.Replace(s, "%", "%%", -1)
+	}
+	return s
+}
+
+type expander struct {
+	src    map[string][]string
+	env    map[string]string
+	joiner *joiner
+	allow  []keyPattern   // The names that may be expanded, or nil to expand all names.
+	calc   bool           // Whether $(( EXPR )) arithmetic is evaluated.
+	active map[string]int // Keys currently being expanded, mapped to the index of the value being expanded.
+	done   map[string]bool
+}
+
+// allowedParam returns whether the braced reference param is expanded.
+func (e *expander) allowedParam(param string) bool {
+	name, _, _ := splitParam(param)
+	return e.allowed(name)
+}
+
+// allowed returns whether references to name are expanded.
+func (e *expander) allowed(name string) bool {
+	if e.allow == nil {
+		return true
+	}
+	for _, p := range e.allow {
+		if p.match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *expander) expandKey(key string) {
+	if e.done[key] {
+		return
+	}
+	vs := e.src[key]
+	for i, v := range vs {
+		e.active[key] = i
+		vs[i] = e.expand(key, v)
+	}
+	delete(e.active, key)
+	e.done[key] = true
+}
+
+// lookup returns the value of name, as resolved by resolve. A reference that's a cycle or can't be resolved is logged
+// and resolves to an empty string.
+func (e *expander) lookup(from, name string) string {
+	if i, ok := e.active[name]; ok && i == 0 {
+		log("cycle in reference to ", strconv.Quote(name), " from ", strconv.Quote(from))
+		return ""
+	}
+	v, ok := e.resolve(name)
+	if !ok {
+		log("unresolved reference to ", strconv.Quote(name), " from ", strconv.Quote(from))
+	}
+	return v
+}
+
+// resolve returns the value of name and whether it's set. A reference that's a cycle isn't set.
+func (e *expander) resolve(name string) (string, bool) {
+	if i, ok := e.active[name]; ok {
+		if i == 0 {
+			return "", false
+		}
+		return e.joiner.join(name, e.src[name][:i]), true
+	}
+
+	if vs, ok := e.src[name]; ok {
+		e.expandKey(name)
+		return e.joiner.join(name, vs), true
+	}
+
+	v, ok := e.env[name]
+	return v, ok
+}
+
+// expandParam returns the expansion of the braced reference param, the text between ${ and }. As in a shell, param
+// may be NAME, for the value of NAME, or one of the following forms, where WORD is expanded only if it's used:
+// NAME:-WORD, for the value of NAME, or WORD if NAME is unset or empty; NAME:+WORD, for WORD if NAME is set and not
+// empty, or else an empty string; or NAME:?WORD, for the value of NAME, exiting with WORD as an error if NAME is unset
+// or empty.
+func (e *expander) expandParam(from, param string) string {
+	name, op, word := splitParam(param)
+	if op == 0 {
+		return e.lookup(from, name)
+	}
+
+	v, ok := e.resolve(name)
+	set := ok && v != ""
+	switch {
+	case op == '-' && !set:
+		return e.expand(from, word)
+	case op == '+' && set:
+		return e.expand(from, word)
+	case op == '+':
+		return ""
+	case op == '?' && !set:
+		if msg := e.expand(from, word); msg != "" {
+			fatal(exitUsage, name, " (referenced by ", from, "): ", msg)
+		}
+		fatal(exitUsage, name, " (referenced by ", from, "): not set")
+	}
+	return v
+}
+
+// braceEnd returns the index of the } closing a braced reference in s, skipping balanced braces within it, or -1 if the
+// reference is unterminated.
+func braceEnd(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+func (e *expander) expand(key, s string) string {
+	if strings.IndexByte(s, '$') == -1 && (!winExpand || strings.IndexByte(s, '%') == -1) {
+		return s
+	}
+
+	var b bytes.Buffer
+	b.Grow(len(s))
+	for i := 0; i < len(s); {
+		if winExpand && s[i] == '%' {
+			i += e.expandPercent(&b, key, s[i:])
+			continue
+		}
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+
+		switch c := s[i+1]; {
+		case c == '$':
+			b.WriteByte('$')
+			i += 2
+		case c == '(' && e.calc && strings.HasPrefix(s[i:], "$(("):
+			i += e.expandArithmetic(&b, key, s[i:])
+		case c == '{':
+			end := braceEnd(s[i+2:])
+			if end <= 0 { // Unterminated or empty -- leave as-is
+				b.WriteByte('$')
+				i++
+				continue
+			}
+			if param := s[i+2 : i+2+end]; e.allowedParam(param) {
+				b.WriteString(e.expandParam(key, param))
+			} else {
+				b.WriteString(s[i : i+end+3])
+			}
+			i += end + 3
+		case isNameStart(c):
+			end := i + 2
+			for end < len(s) && isNameByte(s[end]) {
+				end++
+			}
+			if name := s[i+1 : end]; e.allowed(name) {
+				b.WriteString(e.lookup(key, name))
+			} else {
+				b.WriteString(s[i:end])
+			}
+			i = end
+		default:
+			b.WriteByte('$')
+			i++
+		}
+	}
+	return b.String()
+}
+
+// expandPercent writes the expansion of the %NAME% reference or %% escape at the start of s to b, returning the number
+// of bytes of s it consumed. A % that doesn't begin either is written as-is.
+func (e *expander) expandPercent(b *bytes.Buffer, key, s string) int {
+	if strings.HasPrefix(s, "%%") {
+		b.WriteByte('%')
+		return 2
+	}
+
+	end := 1
+	for end < len(s) && (isNameByte(s[end]) || s[end] == '.') {
+		end++
+	}
+	if end == 1 || !isNameStart(s[1]) || end == len(s) || s[end] != '%' {
+		b.WriteByte('%')
+		return 1
+	}
+
+	if name := s[1:end]; e.allowed(name) {
+		b.WriteString(e.lookup(key, name))
+	} else {
+		b.WriteString(s[:end+1])
+	}
+	return end + 1
+}
+
+// splitParam splits the braced reference param into the name it references and, if it's of the form NAME:<op>WORD,
+// its operator (-, +, or ?) and word. If param is only a name, op is 0.
+func splitParam(param string) (name string, op byte, word string) {
+	if idx := strings.IndexByte(param, ':'); idx != -1 && idx+1 < len(param) && strings.IndexByte("-+?", param[idx+1]) != -1 {
+		return param[:idx], param[idx+1], param[idx+2:]
+	}
+	return param, 0, ""
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isNameByte(c byte) bool {
+	return isNameStart(c) || ('0' <= c && c <= '9')
+}
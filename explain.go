@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// origin is a value set for a key and where it was set from.
+type origin struct {
+	source   string
+	value    string
+	replaced bool // Whether the value was replaced by a later file under -R.
+}
+
+// origins records the values set for each key by addValue, in order, if not nil (-explain).
+var origins map[string][]origin
+
+func recordOrigin(key, value, source string) {
+	if origins != nil {
+		origins[key] = append(origins[key], origin{source: source, value: value})
+	}
+}
+
+// replaceOrigins marks the values recorded for key so far as replaced.
+func replaceOrigins(key string) {
+	for i := range origins[key] {
+		origins[key][i].replaced = true
+	}
+}
+
+// writeExplain writes the values set for key to w, in the order they were set, along with where each was set from and
+// the value of key once merged. If each value set for key is still held by src, the values kept by j are marked as
+// kept, and others as dropped.
+func writeExplain(w io.Writer, key string, src map[string][]string, j *joiner) error {
+	key = canonicalKey(key)
+	recorded := origins[key]
+
+	var active []int
+	for i, o := range recorded {
+		if !o.replaced {
+			active = append(active, i)
+		}
+	}
+
+	// Values can only be matched to their origins if none were combined, e.g., by list operations
+	status := make([]string, len(recorded))
+	values, set := src[key]
+	if set && len(values) == len(active) {
+		kept := map[string]int{}
+		for _, v := range j.kept(key, values) {
+			kept[v]++
+		}
+		fromLast := j.dropRepeats && !j.keepFirst
+		for n := range active {
+			if fromLast {
+				n = len(active) - 1 - n
+			}
+			if v := values[n]; kept[v] > 0 {
+				kept[v]--
+				status[active[n]] = "kept"
+			} else {
+				status[active[n]] = "dropped"
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(key + ":\n")
+	for i, o := range recorded {
+		fmt.Fprintf(&b, "  %d. %s: %s", i+1, o.source, strconv.Quote(maskValue(key, o.value)))
+		if o.replaced {
+			b.WriteString(" (replaced)")
+		} else if status[i] != "" {
+			b.WriteString(" (" + status[i] + ")")
+		}
+		b.WriteString("\n")
+	}
+
+	if set {
+		b.WriteString("result: " + strconv.Quote(maskValue(key, j.join(key, values))) + "\n")
+	} else if len(recorded) > 0 {
+		b.WriteString("result: excluded\n")
+	} else {
+		b.WriteString("result: not set\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
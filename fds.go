@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// closeInheritedFDs marks every open file descriptor above 2 that isn't in keep as close-on-exec, so that the command
+// doesn't inherit it, whether it's exec-ed or run as a child. Open descriptors are listed from /proc/self/fd or
+// /dev/fd. Where neither is available, every descriptor up to the open file limit is marked instead.
+func closeInheritedFDs(keep FDs) {
+	kept := make(map[int]bool, len(keep))
+	for _, fd := range keep {
+		kept[fd] = true
+	}
+
+	for _, fd := range openFDs() {
+		if fd > 2 && !kept[fd] {
+			syscall.CloseOnExec(fd)
+		}
+	}
+}
+
+// openFDs returns the file descriptors open in this process.
+func openFDs() []int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		f, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			continue
+		}
+
+		fds := make([]int, 0, len(names))
+		for _, name := range names {
+			if fd, err := strconv.Atoi(name); err == nil {
+				fds = append(fds, fd)
+			}
+		}
+		return fds
+	}
+
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		log("unable to list open file descriptors: ", err)
+		return nil
+	}
+	fds := make([]int, lim.Cur)
+	for i := range fds {
+		fds[i] = i
+	}
+	return fds
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+// closeInheritedFDs only logs that descriptors can't be closed, since file descriptors are a Unix concept.
+func closeInheritedFDs(keep FDs) {
+	log("unable to close file descriptors: ", errUnsupported)
+}
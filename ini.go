@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	ini "go.spiff.io/go-ini"
+)
+
+// configReader is an ini.Reader with additional options for how binit reads INI files.
+type configReader struct {
+	ini.Reader
+
+	// casing is applied to keys in place of the Reader's Casing, since it supports transformations that ini.KeyCase
+	// can't express.
+	casing keyCasing
+
+	// stripComments controls whether trailing #comments are stripped from unquoted values.
+	stripComments bool
+
+	// crlf controls whether CRLF line endings are folded to LF in INI and dotenv files before they're parsed.
+	crlf bool
+
+	// collapse controls whether repeated keys in a file are joined into a single value, using seps, as the file is
+	// loaded.
+	collapse bool
+	seps     *Separators
+
+	// strict controls whether errors reading or parsing files are fatal.
+	strict bool
+
+	// timeout is the time limit for fetching files given as URLs.
+	timeout time.Duration
+
+	// retries is the number of times to retry fetching a URL, waiting retryDelay before the first retry and twice as
+	// long before each one after it.
+	retries    int
+	retryDelay time.Duration
+
+	// replace controls whether INI keys without a trailing + replace earlier values.
+	replace bool
+
+	// flagsSet holds the names of flags given on the command line, whose settings can't be changed by [binit]
+	// sections.
+	flagsSet map[string]bool
+
+	// exec is the command to run if none is given on the command line, as set by a [binit] section.
+	exec string
+
+	// eofMarker, if not empty, ends input read from standard input at a line equal to it.
+	eofMarker string
+
+	// env is the environment that conditions in [binit.if COND] sections fall back to.
+	env map[string]string
+
+	// sections, if not nil, are the patterns of the sections whose keys are loaded from INI files. Keys in other
+	// sections, and keys outside any section, are skipped (-section).
+	sections []keyPattern
+
+	// including holds the absolute paths of the INI files currently being loaded, outermost first, to detect include
+	// cycles.
+	including []string
+}
+
+// binitSection is the name of the INI section whose keys configure binit instead of setting variables.
+const binitSection = "binit"
+
+// binitSettings maps the names of settings in [binit] sections to the flags they correspond to.
+var binitSettings = map[string][]string{
+	"separator": {"S"},
+	"casing":    {"c"},
+	"sep":       {"s", "sr"},
+	"exec":      nil, // Overridden by giving a command instead
+}
+
+// includeSetting is the name of the [binit] setting that loads another INI file. Unlike other settings, it may be
+// repeated to include multiple files.
+const includeSetting = "include"
+
+// inSection returns whether key, as read from an INI file, is in a section matching any of sections. Each part of key
+// preceding a separator is matched, so that the keys of a section (e.g., [db.primary]) are in its parent sections as
+// well (e.g., db). A key without a separator isn't in any section.
+func inSection(key, sep string, sections []keyPattern) bool {
+	if sep == "" {
+		return false
+	}
+	for end := strings.Index(key, sep); end != -1; {
+		for _, p := range sections {
+			if p.match(key[:end]) {
+				return true
+			}
+		}
+		next := strings.Index(key[end+len(sep):], sep)
+		if next == -1 {
+			break
+		}
+		end += len(sep) + next
+	}
+	return false
+}
+
+// splitCondition splits a [binit] key of the form "if COND<sep>KEY", from a [binit.if COND] section, into its
+// condition and key. ok is false if key isn't from such a section. The condition ends at the first separator, so it
+// can't contain one.
+func splitCondition(key, sep string) (cond, rest string, ok bool) {
+	if len(key) < 3 || !strings.EqualFold(key[:3], "if ") {
+		return "", "", false
+	}
+	idx := strings.Index(key, sep)
+	if sep == "" || idx == -1 {
+		return "", "", false
+	}
+	return strings.TrimSpace(key[3:idx]), key[idx+len(sep):], true
+}
+
+// evalCondition evaluates cond, one of NAME==VALUE, NAME!=VALUE, NAME (NAME is set), or !NAME (NAME isn't set),
+// looking up the values of names with lookup. Spaces around names and values are ignored.
+func evalCondition(cond string, lookup func(string) (string, bool)) (bool, error) {
+	op, name, want := "", cond, ""
+	if idx := strings.Index(cond, "=="); idx != -1 {
+		op, name, want = "==", cond[:idx], cond[idx+2:]
+	} else if idx := strings.Index(cond, "!="); idx != -1 {
+		op, name, want = "!=", cond[:idx], cond[idx+2:]
+	} else if strings.HasPrefix(cond, "!") {
+		op, name = "!", cond[1:]
+	}
+
+	if name = strings.TrimSpace(name); name == "" {
+		return false, errors.New("missing name")
+	}
+	value, set := lookup(name)
+	switch op {
+	case "==":
+		return set && value == strings.TrimSpace(want), nil
+	case "!=":
+		return !set || value != strings.TrimSpace(want), nil
+	case "!":
+		return !set, nil
+	}
+	return set, nil
+}
+
+// fileOptions are the settings that may be given as options to INI files (see parseFileOptions). The sep setting isn't
+// one of them, since values are joined once all files are loaded.
+var fileOptions = map[string]bool{
+	"separator": true,
+	"casing":    true,
+}
+
+// withOptions applies the options given for an INI file to dec, taking precedence over flags, and returns a function
+// that restores the settings those options replaced. Changes made to other settings by a [binit] section of the file
+// are kept for the files loaded after it.
+func (dec *configReader) withOptions(opts map[string]string) (restore func()) {
+	restore = func() {}
+	if value, ok := opts["separator"]; ok {
+		separator, sep := dec.Separator, dec.casing.sep
+		dec.Separator, dec.casing.sep = value, value
+		restore = func() { dec.Separator, dec.casing.sep = separator, sep }
+	}
+	if value, ok := opts["casing"]; ok {
+		modes, next := dec.casing.modes, restore
+		dec.casing.modes = parseCasing(value)
+		restore = func() { dec.casing.modes = modes; next() }
+	}
+	return restore
+}
+
+// splitWords splits s into words as a POSIX shell would, without expanding anything. Words are separated by
+// whitespace, and may be single-quoted (taken literally), double-quoted (where \ escapes ", \, $, and `), or contain
+// characters escaped by \.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '\t', '\r', '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				} else if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`\n", s[i+1]) != -1 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, errors.New("unterminated double quote")
+			}
+		case '\\':
+			if i++; i < len(s) && s[i] != '\n' {
+				word.WriteByte(s[i])
+			}
+		default:
+			word.WriteByte(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// configure applies the settings of a [binit] section read from source, unless they're overridden by flags. It returns
+// whether the settings change how keys are read, in which case source must be read again.
+func (dec *configReader) configure(settings map[string]string, source string) (reread bool) {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := settings[name]
+		flags, ok := binitSettings[name]
+		if !ok {
+			log("unknown setting in [", binitSection, "] section of ", source, ": ", name)
+			continue
+		}
+		overridden := false
+		for _, f := range flags {
+			overridden = overridden || dec.flagsSet[f]
+		}
+		if overridden {
+			debug(source, ": ignoring [", binitSection, "] ", name, " setting: set by -", flags[0])
+			continue
+		}
+
+		debug(source, ": [", binitSection, "] set ", name, "=", strconv.Quote(value))
+		switch name {
+		case "separator":
+			reread = reread || value != dec.Separator
+			dec.Separator, dec.casing.sep = value, value
+		case "casing":
+			casing := keyCasing{modes: parseCasing(value), sep: dec.casing.sep}
+			reread = reread || !casing.equal(dec.casing)
+			dec.casing = casing
+		case "sep":
+			dec.seps.sep = unquoteSeparator(value)
+			reread = reread || dec.collapse
+		case "exec":
+			dec.exec = value
+		}
+	}
+	return reread
+}
+
+// fail logs an error reading or parsing a file. If dec is strict, binit exits with code.
+func (dec *configReader) fail(code int, args ...interface{}) {
+	if dec.strict {
+		fatal(code, args...)
+	}
+	log(args...)
+}
+
+type caseMode int
+
+const (
+	caseSensitive caseMode = iota
+	upperCase
+	lowerCase
+	titleCase // Capitalize each word of a key, where words are separated by the key separator, - or _
+	envCase   // Replace the key separator and - with _ and uppercase, as in conventional env var names
+)
+
+// keyCasing is a sequence of case transformations applied, in order, to keys loaded from files or set as defaults.
+type keyCasing struct {
+	modes []caseMode
+	sep   string // The key separator
+}
+
+// equal returns whether c and o transform keys the same way.
+func (c keyCasing) equal(o keyCasing) bool {
+	if c.sep != o.sep || len(c.modes) != len(o.modes) {
+		return false
+	}
+	for i, m := range c.modes {
+		if m != o.modes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c keyCasing) apply(key string) string {
+	for _, mode := range c.modes {
+		switch mode {
+		case upperCase:
+			key = strings.ToUpper(key)
+		case lowerCase:
+			key = strings.ToLower(key)
+		case titleCase:
+			key = titleKey(key, c.sep)
+		case envCase:
+			if c.sep != "" {
+				key = strings.Replace(key, c.sep, "_", -1)
+			}
+			key = strings.ToUpper(strings.Replace(key, "-", "_", -1))
+		}
+	}
+	return key
+}
+
+func titleKey(key, sep string) string {
+	var b strings.Builder
+	b.Grow(len(key))
+	start := true
+	for i := 0; i < len(key); {
+		if sep != "" && strings.HasPrefix(key[i:], sep) {
+			b.WriteString(sep)
+			i += len(sep)
+			start = true
+			continue
+		}
+
+		r, n := utf8.DecodeRuneInString(key[i:])
+		if start {
+			r = unicode.ToUpper(r)
+		} else {
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+		i += n
+		start = r == '-' || r == '_'
+	}
+	return b.String()
+}
+
+// foldCRLF replaces each CRLF line ending in b with LF, and removes a CR at the end of b.
+func foldCRLF(b []byte) []byte {
+	b = bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.TrimSuffix(b, []byte("\r"))
+}
+
+// stripINIComments removes trailing #comments from the unquoted values of INI source b. A comment must be preceded by
+// whitespace, so that a # within a value (e.g., in a URL) is kept. Quoted values, which may span multiple lines, are
+// left as-is.
+func stripINIComments(b []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(b))
+	for i := 0; i < len(b); {
+		end := lineEnd(b, i)
+		line := b[i:end]
+		trimmed := bytes.TrimLeft(line, " \t")
+		eq := bytes.IndexByte(line, '=')
+		if eq == -1 || len(trimmed) == 0 || trimmed[0] == '[' || trimmed[0] == '#' || trimmed[0] == ';' {
+			out.Write(line)
+			i = end
+			continue
+		}
+
+		value := bytes.TrimLeft(line[eq+1:], " \t")
+		if len(value) > 0 && (value[0] == '"' || value[0] == '`') {
+			// Copy everything through the end of the line holding the closing quote
+			start := end - len(value)
+			closing := closingQuote(b, start+1, value[0])
+			if closing == -1 {
+				out.Write(b[i:])
+				break
+			}
+			end = lineEnd(b, closing)
+			out.Write(b[i:end])
+			i = end
+			continue
+		}
+
+		content := bytes.TrimRight(line, "\r\n")
+		out.Write(line[:eq+1])
+		out.WriteString(stripComment(string(content[eq+1:])))
+		out.Write(line[len(content):])
+		i = end
+	}
+	return out.Bytes()
+}
+
+// lineEnd returns the index following the end of the line in b that includes the byte at i.
+func lineEnd(b []byte, i int) int {
+	if n := bytes.IndexByte(b[i:], '\n'); n != -1 {
+		return i + n + 1
+	}
+	return len(b)
+}
+
+// closingQuote returns the index of the quote character q in b that closes a quoted string beginning before i, or -1
+// if there isn't one. Backslashes escape the following character in double-quoted strings.
+func closingQuote(b []byte, i int, q byte) int {
+	for ; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == q:
+			return i
+		case c == '\\' && q == '"':
+			i++
+		}
+	}
+	return -1
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// importJSONFile loads a JSON object from the file at path into dst. Nested objects are flattened, joining their keys
+// to their parents' using the separator of dec, and arrays are loaded as multiple values for their key. Numbers and
+// booleans are loaded as their JSON text, while nulls are skipped. Keys are cased according to dec.
+func importJSONFile(dst map[string][]string, path string, dec *configReader) {
+	b, err := dec.readInput(path)
+	if err != nil {
+		dec.fail(exitFailure, "error reading <", path, ">: ", err)
+		return
+	}
+
+	var obj map[string]interface{}
+	jd := json.NewDecoder(bytes.NewReader(b))
+	jd.UseNumber()
+	if err = jd.Decode(&obj); err != nil {
+		dec.fail(exitDataErr, "error parsing JSON ", path, ": ", err)
+		return
+	}
+
+	values := map[string][]string{}
+	if err = flattenJSON(values, "", obj, dec); err != nil {
+		dec.fail(exitDataErr, "error loading JSON ", path, ": ", err)
+		return
+	}
+	copyLists(dst, values, path)
+}
+
+// flattenJSON adds the values of obj to dst, with each key prefixed by prefix. Keys are visited in sorted order.
+func flattenJSON(dst map[string][]string, prefix string, obj map[string]interface{}, dec *configReader) error {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		key := k
+		if prefix != "" {
+			key = prefix + dec.Separator + key
+		}
+
+		cased := dec.casing.apply(key)
+		switch v := obj[k].(type) {
+		case map[string]interface{}:
+			if err := flattenJSON(dst, key, v, dec); err != nil {
+				return err
+			}
+		case []interface{}:
+			for _, elem := range v {
+				s, ok := jsonScalar(elem)
+				if !ok {
+					return fmt.Errorf("%s: arrays may only hold strings, numbers, and booleans", key)
+				}
+				dst[cased] = append(dst[cased], s)
+			}
+		case nil:
+		default:
+			s, _ := jsonScalar(v)
+			dst[cased] = append(dst[cased], s)
+		}
+	}
+	return nil
+}
+
+func jsonScalar(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	}
+	return "", false
+}
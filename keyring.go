@@ -0,0 +1,43 @@
+//go:build keyring
+// +build keyring
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keyringSecret returns the secret stored in the OS keyring for account under service. On macOS, this reads the
+// login keychain using security(1). On Linux and the BSDs, it reads the Secret Service (e.g., GNOME Keyring or
+// KWallet) using secret-tool(1), looking up the secret by its service and account attributes.
+func keyringSecret(service, account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "linux", "freebsd", "openbsd", "netbsd", "dragonfly":
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	default:
+		return "", fmt.Errorf("no keyring is supported on %s", runtime.GOOS)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("no secret found for %s/%s: %s", service, account, msg)
+		}
+		return "", fmt.Errorf("no secret found for %s/%s", service, account)
+	case err != nil:
+		return "", fmt.Errorf("unable to run %s: %v", cmd.Args[0], err)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
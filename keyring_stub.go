@@ -0,0 +1,11 @@
+//go:build !keyring
+// +build !keyring
+
+package main
+
+import "errors"
+
+// keyringSecret always fails, since binit was built without the keyring tag.
+func keyringSecret(service, account string) (string, error) {
+	return "", errors.New("keyring support is not built in (rebuild binit with -tags keyring)")
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errLocked is returned by acquireLock if another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
+// acquireLock opens the file at path, creating it if it doesn't exist, and takes an exclusive flock(2) on it. If the
+// lock is held by another process, acquireLock waits for it to be released if wait is set, and otherwise returns
+// errLocked. The lock is held until the returned file is closed or every process holding its descriptor exits.
+func acquireLock(path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == syscall.EWOULDBLOCK {
+		err = errLocked
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// inheritFD clears the close-on-exec flag of fd, so that it's kept open across exec.
+func inheritFD(fd uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// errLocked is returned by acquireLock if another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
+// acquireLock always fails, since locks are taken with flock(2).
+func acquireLock(path string, wait bool) (*os.File, error) {
+	return nil, errUnsupported
+}
+
+// inheritFD always fails, since descriptors are only kept across exec on Unix.
+func inheritFD(fd uintptr) error {
+	return errUnsupported
+}
@@ -15,16 +15,24 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	ini "go.spiff.io/go-ini"
 
@@ -42,6 +50,90 @@ func (s *Strings) Set(str string) error {
 	return nil
 }
 
+// CommaStrings is a flag.Value for comma-separated lists of strings. Each use of the flag adds to the list.
+type CommaStrings []string
+
+func (s *CommaStrings) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *CommaStrings) Set(str string) error {
+	for _, v := range strings.Split(str, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
+
+type inputKind int
+
+const (
+	iniInput inputKind = iota
+	iniDirInput
+	dotenvInput
+	jsonInput
+	tomlInput
+	systemdInput
+	processInput
+	varInput
+)
+
+// input is a file to load values from, of a given format. Inputs are loaded in the order they're given on the command
+// line, regardless of format.
+type input struct {
+	kind inputKind
+	path string
+	opts map[string]string // Options for reading INI files, given as PATH;NAME=VALUE;...
+}
+
+// Inputs is a flag.Value that appends inputs of a single kind to a shared list of inputs.
+type Inputs struct {
+	list *[]input
+	kind inputKind
+}
+
+func (s Inputs) String() string {
+	return "[]"
+}
+
+func (s Inputs) Set(str string) error {
+	in := input{kind: s.kind, path: str}
+	if s.kind == iniInput || s.kind == iniDirInput {
+		var err error
+		if in.path, in.opts, err = parseFileOptions(str); err != nil {
+			return err
+		}
+	}
+	*s.list = append(*s.list, in)
+	return nil
+}
+
+// parseFileOptions splits an INI file given as PATH;NAME=VALUE;... into its path and options. Options may be any of the
+// settings of a [binit] section that configure how a file is read. If str has no options, such as when a part following
+// a ; has no =, it's returned as the path.
+func parseFileOptions(str string) (path string, opts map[string]string, err error) {
+	parts := strings.Split(str, ";")
+	for _, opt := range parts[1:] {
+		if !strings.Contains(opt, "=") {
+			return str, nil, nil
+		}
+	}
+
+	for _, opt := range parts[1:] {
+		idx := strings.IndexByte(opt, '=')
+		name, value := strings.ToLower(strings.TrimSpace(opt[:idx])), opt[idx+1:]
+		if !fileOptions[name] {
+			return "", nil, fmt.Errorf("unknown file option %q", name)
+		}
+		if opts == nil {
+			opts = map[string]string{}
+		}
+		opts[name] = value
+	}
+	return parts[0], opts, nil
+}
+
 // compileWildcard converts a splat string (a string containing either ? or * to indicate a match-one or match-zero-to-N
 // wildcard, respectively) to a regular expression for string matching. This is the rough equivalent of taking
 // instructions to dig a hole and starting a mine leading down to the center of the earth, but the alternative was using
@@ -57,12 +149,13 @@ func compileWildcard(splat string) (*regexp.Regexp, error) {
 			continue
 		}
 
+		// Wildcards are captured so that they can be referred to by renames (see copyImports)
 		if escape {
 			b.WriteString(regexp.QuoteMeta(string(r)))
 		} else if r == '*' {
-			b.WriteString(".*")
+			b.WriteString("(.*)")
 		} else if r == '?' {
-			b.WriteString(".")
+			b.WriteString("(.)")
 		} else {
 			b.WriteString(regexp.QuoteMeta(string(r)))
 		}
@@ -79,209 +172,2231 @@ func compileWildcard(splat string) (*regexp.Regexp, error) {
 	return regexp.Compile(pat)
 }
 
-func log(args ...interface{}) { stdlog.Print(args...) }
+// keyPattern matches keys against a name that may contain wildcards (as understood by compileWildcard).
+type keyPattern struct {
+	name string
+	re   *regexp.Regexp // nil if name is matched literally
+}
+
+// compilePattern compiles name as a keyPattern. If name contains no wildcards, or it fails to compile, the pattern
+// matches only name itself. what describes the use of the pattern in logged errors.
+func compilePattern(name, what string) keyPattern {
+	if !strings.ContainsAny(name, "*?") {
+		return keyPattern{name: name}
+	}
+
+	re, err := compileWildcard(name)
+	if err != nil {
+		log("unable to compile pattern-like ", what, " ", strconv.Quote(name), ": ", err)
+		return keyPattern{name: name}
+	}
+	return keyPattern{name: name, re: re}
+}
+
+func (p keyPattern) literal() bool {
+	return p.re == nil
+}
+
+func (p keyPattern) match(key string) bool {
+	if p.re == nil {
+		return key == p.name
+	} else if wildcardSep != "" {
+		return matchSegments(p.name, key, wildcardSep)
+	}
+	return p.re.MatchString(key)
+}
+
+// wildcardSep, if not empty, is the separator that wildcards don't match across (-strict-wildcards).
+var wildcardSep string
+
+// segmentPatterns caches the compiled segments of patterns matched by matchSegments.
+var segmentPatterns = map[string][]*regexp.Regexp{}
+
+// matchSegments returns whether key matches the wildcard pattern name, where name and key are split at sep into
+// segments, and each segment of name must match the corresponding segment of key. Wildcards therefore never match sep,
+// in the same way that shell globs don't match /.
+func matchSegments(name, key, sep string) bool {
+	pats, ok := segmentPatterns[name]
+	if !ok {
+		for _, seg := range strings.Split(name, sep) {
+			re, err := compileWildcard(seg)
+			if err != nil {
+				log("unable to compile pattern ", strconv.Quote(name), ": ", err)
+				pats = nil
+				break
+			}
+			pats = append(pats, re)
+		}
+		segmentPatterns[name] = pats
+	}
+
+	segs := strings.Split(key, sep)
+	if pats == nil || len(segs) != len(pats) {
+		return false
+	}
+	for i, seg := range segs {
+		if !pats[i].MatchString(seg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Logging is leveled: log writes warnings unless quiet is set, debug writes only if verbose is set, and logError and
+// fatal always write, since they're only used for errors that cause binit to exit.
+var (
+	quiet     bool
+	verbose   bool
+	logFormat = textLog
+)
+
+// logFormatFlag is a flag.Value for the format log messages are written in (-log-format).
+type logFormatFlag string
+
+const (
+	textLog logFormatFlag = "text"
+	jsonLog logFormatFlag = "json"
+)
+
+func (f *logFormatFlag) String() string {
+	return string(*f)
+}
+
+func (f *logFormatFlag) Set(str string) error {
+	switch next := logFormatFlag(str); next {
+	case textLog, jsonLog:
+		*f = next
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q", str)
+}
+
+// logMessage is a log message as written under -log-format json.
+type logMessage struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// writeLog writes a log message at the given level. Under -log-format json, each message is written as a JSON object
+// on its own line. Otherwise, only the message is written, prefixed by "binit: ".
+func writeLog(level string, args ...interface{}) {
+	if logFormat != jsonLog {
+		stdlog.Print(args...)
+		return
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(logMessage{Level: level, Message: fmt.Sprint(args...)}); err != nil {
+		stdlog.Print(args...)
+		return
+	}
+	stdlog.Print(b.String())
+}
+
+func log(args ...interface{}) {
+	if !quiet {
+		writeLog("warning", args...)
+	}
+}
+
+func debug(args ...interface{}) {
+	if verbose {
+		writeLog("debug", args...)
+	}
+}
+
+func logError(args ...interface{}) { writeLog("error", args...) }
+
+// fatal logs args and exits with the given status code.
+func fatal(code int, args ...interface{}) {
+	logError(args...)
+	os.Exit(code)
+}
 
 func main() {
 	stdlog.SetPrefix("binit: ")
 	stdlog.SetFlags(0)
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTION]... [--] [CMD [ARG]...]\n", flag.CommandLine.Name())
+		flag.PrintDefaults()
+	}
 
 	var assigned []string
+	var defaults []string
 
+	printVersion := flag.Bool("version", false, "Print the version and build information and exit.")
 	dropRepeats := flag.Bool("n", false, "Whether to pick only the last-set value for an environment value.")
 	keepFirst := flag.Bool("N", false, "Keep first values instead of last (implies -n).")
-	casingFlag := flag.String("c", "s", "Case transformations to apply to keys. (c=case-sensitive; u=uppercase; d=lowercase)")
+	templates := flag.Bool("T", false, "Render values containing {{ as Go text/templates, with .Env (the current environment) and .Values (the merged environment).")
+	calc := flag.Bool("calc", false, "Evaluate $((EXPR)) integer arithmetic in values, where EXPR may use + - * / and refer to other keys by name.")
+	normalizeBools := flag.Bool("b", false, "Normalize boolean values (yes/no, on/off, 1/0, true/false) to true or false.")
+	collapse := flag.Bool("a", false, "Join repeated keys in each INI file into a single value with the -s separator as the file is loaded.")
+	count := flag.Bool("count", false, "Add a KEY.COUNT variable, using the -S separator, with the number of values of each key with more than one value.")
+	countSuffix := flag.String("count-suffix", "COUNT", "The `suffix` of -count variables, added to their keys after the -S separator.")
+	countAll := flag.Bool("count-all", false, "Add -count variables for keys with only one value, as well (implies -count).")
+	dropEmpty := flag.Bool("drop-empty", false, "Unset variables whose merged values are empty, instead of passing them to the command with empty values.")
+	dedup := flag.Bool("u", false, "Drop duplicate values of multi-value keys, keeping the first occurrence of each.")
+	casingFlag := flag.String("c", "s", "Case transformations to apply to keys, as a comma-separated list applied in order. (c=case-sensitive; u=uppercase; d=lowercase; t=title; e=env)")
+	foldCase := flag.Bool("ci", false, "Merge keys that differ only in case, keeping the casing each key was first set with.")
+	replace := flag.Bool("R", false, "INI keys replace values set before their file is loaded, unless written as key+ = value to append.")
 	configLast := flag.Bool("L", false, "Gives config file values precedence over values from the environment.")
 	ksep := flag.String("S", ".", "The string `separator` inserted between group names and keys.")
-	sep := flag.String("s", " ", "The string `separator` inserted between multi-value keys. May include Go escape characters if quoted according to Go.")
+	ksepOut := flag.String("So", "", "The string `separator` that replaces the -S separator in keys passed to the command. (default the -S separator)")
+	sep := Separators{sep: " "}
+	listSep := Separators{sep: ":"}
+	keepPath := flag.Bool("keep-path", false, "Import PATH from the environment even if -i or -m is given. (Equivalent to -m PATH)")
 	clean := flag.Bool("i", false, "Whether to omit current environment variables from the exec.")
+	exportPrefix := flag.String("P", "", "A `prefix` to add to the names of all variables passed to the command.")
+	importPrefix := flag.String("p", "", "A `prefix` to strip from the names of variables imported with -m. Stripped names are cased per -c.")
+	dir := flag.String("C", "", "Change to `dir`ectory before running the command. Relative -f and other file paths are still resolved against the current directory.")
+	runUser := flag.String("U", "", "Run the command as `user`, given as a name or numeric ID. Supplementary groups are set to the user's.")
+	runGroup := flag.String("G", "", "Run the command with the primary `group` given as a name or numeric ID, instead of the -U user's.")
+	shell := flag.Bool("shell", false, "Run the command as a script with the -shell-bin shell, as in sh -c CMD [ARG]..., instead of exec-ing it directly.")
+	shellBin := flag.String("shell-bin", "/bin/sh", "The `shell` that runs the command under -shell. Searched for in PATH if it doesn't contain a slash.")
+	cleanPathMissing := flag.Bool("clean-path-missing", false, "Also remove entries naming directories that don't exist from -clean-path keys.")
+	closeFDs := flag.Bool("close-fds", false, "Close all file descriptors above 2 (standard input, output, and error) when running the command, except those given by -keep-fds.")
+	lockFile := flag.String("lock", "", "Take an exclusive lock on `file` before running the command, held until it exits. If it's locked, exit with status 75.")
+	lockWait := flag.Bool("lock-wait", false, "Wait for the -lock file to be unlocked instead of exiting.")
+	setsid := flag.Bool("setsid", false, "Run the command in a new session, detached from the controlling terminal. Under -w, the command is started in a new session instead of binit.")
+	argv0 := flag.String("argv0", "", "Pass `name` to the command as its argv[0] instead of its resolved path.")
+	explain := flag.String("explain", "", "Print each value set for `key`, where it was set from, and the key's merged value, instead of running a command.")
+	dryRun := flag.Bool("D", false, "Print the command, arguments, and environment that would be exec-ed to standard error instead of exec-ing.")
+	wait := flag.Bool("w", false, "Run the command as a child process and wait for it to exit, instead of exec-ing it. Exits with the command's exit status.")
+	reapChildren := flag.Bool("1", false, "Reap all child processes while waiting for the command, as an init (PID 1) process must (implies -w).")
+	teeFile := flag.String("tee", "", "Append the command's standard output and error to `file` while passing them through (implies -w).")
+	teeOut := flag.String("tee-out", "", "Append the command's standard output to `file` while passing it through, in place of -tee (implies -w).")
+	teeErr := flag.String("tee-err", "", "Append the command's standard error to `file` while passing it through, in place of -tee (implies -w).")
+	runTimeout := flag.Duration("run-timeout", 0, "The `duration` the command may run before it's sent SIGTERM and binit exits with status 124 (implies -w).")
+	grace := flag.Duration("grace", 10*time.Second, "The `duration` to wait after sending SIGTERM under -run-timeout before sending SIGKILL.")
+	var forward Signals
+	var order sortOrder
+	var diff diffMode
+	var keepFDs FDs
+	var cleanPathKeys Strings
+	var onlyPrefixes Strings
+	var quote quoteStyle
+	var strategies Strategies
+	flag.BoolVar(&quiet, "q", false, "Suppress warnings, logging only errors that cause binit to exit.")
+	flag.Var(&logFormat, "log-format", "The `format` to write log messages in. (text, json)")
+	flag.BoolVar(&verbose, "v", false, "Log each variable as it's set and where it was set from.")
+	checkNUL := flag.Bool("check-nul", false, "Exit with an error if any variable's name or value contains a NUL byte, which the OS would truncate it at. (implied by -strict)")
+	schemaFile := flag.String("schema", "", "An INI `file` whose keys are the only variables that may be set, other than those inherited. Keys may include wildcards. Unknown variables are errors under -strict.")
+	strictWildcards := flag.Bool("strict-wildcards", false, "Wildcards in patterns don't match the -S separator, so a.* matches a.b but not a.b.c.")
+	strict := flag.Bool("strict", false, "Exit with an error if any file can't be read or parsed, a name is invalid under -posix, a template fails under -T, a value contains NUL, or a variable isn't in the -schema, instead of logging a warning.")
+	posix := flag.Bool("posix", false, "Skip variables whose names aren't valid POSIX names (letters, digits, and _, not starting with a digit). Under -strict, exit with an error instead.")
+	timeout := flag.Duration("timeout", 30*time.Second, "The `duration` to wait for a file given as an http or https URL to be fetched. (0 waits indefinitely)")
+	eofMarker := flag.String("eof", "", "Read standard input, when given as a file, only up to a line equal to `marker`, as with a shell here-document, leaving the rest for the command.")
+	retries := flag.Int("retries", 0, "The `number` of times to retry fetching a file given as a URL if it fails.")
+	retryDelay := flag.Duration("retry-delay", time.Second, "The `duration` to wait before retrying a failed fetch under -retries, doubled after each retry.")
+	winExpandFlag := flag.Bool("winexpand", false, "Also expand Windows-style %NAME% references in values, with %% for a literal %.")
+	crlf := flag.Bool("crlf", false, "Fold CRLF line endings to LF in INI and dotenv files, so that values don't end in a carriage return.")
+	stripComments := flag.Bool("#", false, "Strip trailing #comments, preceded by whitespace, from unquoted INI values.")
+	outFile := flag.String("out", "", "Write the environment to `file`, in the -o format, instead of printing it. If a command is given, it's run after the file is written.")
+	hashEnv := flag.Bool("hash", false, "Print a SHA-256 hash of the environment when no command is given, or pass it to the command as BINIT_CONFIG_HASH.")
+	namesOnly := flag.Bool("names", false, "Print only the sorted names of variables, one per line, when no command is given.")
+	introspect := flag.Bool("introspect", false, "Set BINIT_ARGV, BINIT_CWD, and BINIT_CONFIG_FILES to binit's command line, working directory, and -f files.")
+	preserveOrder := flag.Bool("preserve-order", false, "Print variables in the order their keys were first set instead of sorted.")
+	nulTerminate := flag.Bool("0", false, "Terminate each printed KEY=value pair with a NUL byte instead of a newline. (Only applies to -o env and -names.)")
+	format := envFormat
 	var imports = new(Strings)
-	var inputs = new(Strings)
+	var required Strings
+	var excludes Strings
+	var indexedKeys Strings
+	var drops Strings
+	var assignFiles Strings
+	var checks Checks
+	var valueCasings ValueCasings
+	var greps Strings
+	var keeps CommaStrings
+	var expandOnly CommaStrings
+	var sections Strings
+	var inputs []input
 
-	flag.Var(imports, "m", "Import a specific variable from the environment. Implies -i.")
+	flag.Var(imports, "m", "Import a specific variable from the environment, or given as `NAME:TARGET`, import it as TARGET. Implies -i.")
+	flag.Var(&indexedKeys, "indexed", "Set each value of keys matching a `pattern` as a separate variable, suffixed with its index after the -S separator, instead of joining them.")
+	flag.Var(&excludes, "X", "Exclude variables matching a `pattern` from the environment, regardless of where they were set.")
+	flag.Var(maskFlag{}, "mask", "Mask the values of variables matching a `pattern` as **** when printed or logged. They're still passed to the command as-is.")
+	flag.Var(&sections, "section", "Load only keys in sections matching a `pattern` from INI files. May be given multiple times to load multiple sections.")
+	flag.Var(&expandOnly, "expand-only", "A comma-separated `list` of variables that may be referenced by ${NAME} or $NAME in values. References to others are left as written. May include wildcards.")
+	flag.Var(&keeps, "keep", "A comma-separated `list` of variables to keep from the environment, dropping all others. May include wildcards.")
+	flag.Var(&greps, "grep", "Print only variables matching a `pattern` when no command is given. May be repeated to print variables matching any pattern.")
+	flag.Var(&onlyPrefixes, "only", "Print only variables whose names begin with `prefix`, with the prefix removed, when no command is given. May be repeated to print variables with any prefix.")
+	flag.Var(&valueCasings, "cv", "Case transformation to apply to values (upper, lower, none). Given as KEY=MODE, applies to keys matching KEY only.")
+	flag.Var(&checks, "check", "Require the values of variables matching KEY to match a regular expression, given as `KEY=REGEX`.")
+	flag.Var(&drops, "x", "Drop variables matching a `pattern` from the inherited environment before it's merged.")
+	flag.Var(&required, "r", "Require a variable to be set to a non-empty value. May include wildcards to require at least one match.")
 	flag.Var((*Strings)(&assigned), "e", "Set an environment variable (`K=V`).")
-	flag.Var(inputs, "f", "INI `file`s to load into the environment. (Pass - to read from standard input.)")
+	flag.Var(&assignFiles, "ef", "A `file` of K=V lines to set, as with -e. (Pass - to read from standard input.)")
+	flag.Var((*Strings)(&defaults), "d", "Set a default environment variable (`K=V`), used only if it isn't otherwise set.")
+	flag.Var(Inputs{&inputs, iniInput}, "f", "INI `file`s to load into the environment. (Pass - to read from standard input, or an http or https URL to fetch it.) "+
+		"Options for reading a file may follow it, as FILE;casing=MODE;separator=SEP.")
+	flag.Var(Inputs{&inputs, varInput}, "fe", "Load the value of the environment variable `name` as an INI file.")
+	flag.Var(Inputs{&inputs, jsonInput}, "j", "JSON `file`s to load into the environment. (Pass - to read from standard input.)")
+	flag.Var(Inputs{&inputs, tomlInput}, "t", "TOML `file`s to load into the environment. (Pass - to read from standard input.)")
+	flag.Var(Inputs{&inputs, iniDirInput}, "F", "A `dir`ectory of INI files to load into the environment. Files ending in .ini are loaded in sorted order.")
+	flag.Var(&order, "sort-values", "Sort the values of multi-value keys before they're joined, lexically or, given as -sort-values=numeric, numerically.")
+	flag.Var(&keepFDs, "keep-fds", "A comma-separated list of file `descriptors` above 2 to pass to the command under -close-fds (implies -close-fds).")
+	flag.Var(&cleanPathKeys, "clean-path", "Remove duplicate entries, split by the -l separator, from the value of a `key` such as PATH. May include wildcards.")
+	flag.Var(&strategies, "M", "Set the merge `strategy` for multi-value keys matching KEY, as KEY=STRATEGY. (first, last, min, max, join)")
+	flag.Var(&forward, "g", "A comma-separated list of `signals` to relay to the command's process group under -w. (default HUP,INT,QUIT,TERM,USR1,USR2)")
+	flag.Var(&sep, "s", "The string `separator` inserted between multi-value keys. May include Go escape characters if quoted according to Go. "+
+		"Given as KEY=SEP, sets the separator for keys matching KEY only.")
+	flag.Var(RawSeparators{&sep}, "sr", "The string `separator` inserted between multi-value keys, taken literally. Given as KEY=SEP, sets the separator for keys matching KEY only. "+
+		"Whichever of -s and -sr is given last takes precedence.")
+	flag.Var(&listSep, "l", "The list `separator` used to append (+SEP value) or prepend (value SEP+) values to a key's earlier value. "+
+		"Given as KEY=SEP, sets the separator for keys matching KEY only.")
+	flag.Var(&diff, "diff", "Print only variables that are new (+KEY=value) or changed (~KEY=value) from the current environment when no command is given. "+
+		"Given as -diff=verbose, print changed variables' old and new values.")
+	flag.Var(&format, "o", "The `format` to print the environment in when no command is given. (env, json, export, unset, fish, powershell, ini, docker-envfile)")
+	flag.Var(&quote, "quote", "The `shell` to quote printed values for, in place of the -o format's own quoting. (sh, bash, fish, powershell, none)")
+	flag.Var(Inputs{&inputs, systemdInput}, "sd", "systemd EnvironmentFile `file`s to load into the environment. (Pass - to read from standard input.)")
+	flag.Var(Inputs{&inputs, processInput}, "from-pid", "Load the environment of the process with the given `pid`, read from /proc/PID/environ. (Linux only)")
+	flag.Var(Inputs{&inputs, dotenvInput}, "E", "Dotenv `file`s to load into the environment. (Pass - to read from standard input.)")
 
-	flag.Parse()
+	// Invalid flags exit with exitUsage rather than flag's default of 2
+	if err := flag.CommandLine.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(exitUsage)
+	}
 
-	if *keepFirst {
-		*dropRepeats = true
+	if logFormat == jsonLog {
+		stdlog.SetPrefix("")
 	}
 
-	if s := *sep; len(s) > 0 {
-		var err error
-		// It's only going to be a valid Go quote if it starts with a character in ASCII range, so no need to worry about decoding a rune here.
-		switch s[0] {
-		case '`', '\'', '"':
-			s, err = strconv.Unquote(s)
-		default:
-			s, err = strconv.Unquote(`"` + strings.Replace(s, `"`, `\"`, -1) + `"`)
+	// Standard input can only be read once, even up to an -eof marker, since later readers would see only what's left
+	stdinReaders := 0
+	for _, in := range inputs {
+		if in.path == "-" && in.kind != iniDirInput && in.kind != processInput && in.kind != varInput {
+			stdinReaders++
 		}
-		if err == nil {
-			*sep = s
-		} else {
-			log("unable to unquote separator: ", strconv.Quote(*sep))
+	}
+	for _, path := range assignFiles {
+		if path == "-" {
+			stdinReaders++
+		}
+	}
+	if *schemaFile == "-" {
+		stdinReaders++
+	}
+	if stdinReaders > 1 {
+		fatal(exitUsage, "standard input may only be read by one of -f, -E, -j, -t, -sd, -ef, or -schema")
+	}
+
+	if *printVersion {
+		if err := writeVersion(os.Stdout); err != nil {
+			fatal(exitFailure, "error writing version: ", err)
 		}
+		return
+	}
+
+	if *keepFirst {
+		*dropRepeats = true
+	}
+
+	if *countAll {
+		*count = true
+	}
+
+	if *reapChildren || *runTimeout > 0 || *teeFile != "" || *teeOut != "" || *teeErr != "" {
+		*wait = true
+	}
+
+	if *foldCase {
+		foldedKeys = map[string]string{}
+	}
+
+	// Set before any values are loaded, so that % is escaped in values that aren't expanded
+	winExpand = *winExpandFlag
+
+	if *strictWildcards {
+		wildcardSep = *ksep
+	}
+
+	if *explain != "" {
+		origins = map[string][]origin{}
+	}
+
+	if *preserveOrder {
+		keyOrder = map[string]int{}
 	}
 
+	// Flags given on the command line take precedence over [binit] sections of INI files
+	flagsSet := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { flagsSet[f.Name] = true })
+
+	dec := configReader{
+		Reader: ini.Reader{
+			Separator: *ksep,
+			Casing:    ini.CaseSensitive, // Applied by casing instead
+			True:      ini.True,
+		},
+		casing:        keyCasing{modes: parseCasing(*casingFlag), sep: *ksep},
+		stripComments: *stripComments,
+		crlf:          *crlf,
+		collapse:      *collapse,
+		seps:          &sep,
+		strict:        *strict,
+		timeout:       *timeout,
+		replace:       *replace,
+		flagsSet:      flagsSet,
+		eofMarker:     *eofMarker,
+		retries:       *retries,
+		retryDelay:    *retryDelay,
+	}
+	for _, name := range sections {
+		dec.sections = append(dec.sections, compilePattern(name, "section"))
+	}
 	var values = map[string][]string{}
 
 	// Load process environment
 	current := parseEnv(os.Environ())
+	dropInherited(current, drops)
+	dec.env = current
 
 	// Merge imported environment values
 
-	copyCurrent := !*clean && len(*imports) == 0
+	// Inherited values are escaped so that they pass through expansion untouched.
+	inherited := escapeEnv(current)
+	copyCurrent := !*clean && len(*imports) == 0 && len(keeps) == 0
+	if *keepPath && !copyCurrent && !containsString(*imports, "PATH") && !containsString(keeps, "PATH") {
+		*imports = append(*imports, "PATH")
+	}
 	importValues := func() {
 		if copyCurrent {
-			copyValues(values, current)
-		} else {
-			copyImports(values, current, *imports)
+			copyValues(values, inherited, "environment")
+			return
 		}
+
+		// Kept variables are imported as-is, without -p prefixes stripped
+		copyImports(values, inherited, Strings(keeps), func(k string) string { return k })
+		copyImports(values, inherited, *imports, func(k string) string {
+			return stripPrefix(k, *importPrefix, dec.casing)
+		})
+	}
+
+	assigned, appends := splitAppends(assigned)
+	assignedValues, literalKeys, err := readAssignedFiles(parseEnv(assigned))
+	if err != nil {
+		fatal(exitFailure, err)
 	}
 
+	// Values set by -e take precedence over those read by -ef, while keys are added in the order they were first given
+	fileAssigned := readAssignments(assignFiles, &dec)
+	assignedKeys := pairKeys(append(fileAssigned, assigned...))
+	merged := parseEnv(fileAssigned)
+	for k, v := range assignedValues {
+		merged[k] = v
+	}
+	assignedValues = merged
+
 	if !*configLast { // Append environment before loading config files
 		importValues()
-		copyValues(values, parseEnv(assigned))
+		copyAssignments(values, assignedValues, assignedKeys, literalKeys)
 	}
 
-	dec := ini.Reader{
-		Separator: *ksep,
-		Casing:    parseCasing(*casingFlag),
-		True:      ini.True,
-	}
-	for _, path := range *inputs {
-		importConfigFile(values, path, &dec)
+	var configFiles []string // The files loaded by -f, for -introspect.
+	for _, in := range inputs {
+		switch in.kind {
+		case iniInput:
+			restore := dec.withOptions(in.opts)
+			for _, path := range globInput(in.path, &dec) {
+				configFiles = append(configFiles, absPath(path))
+				importConfigFile(values, path, &dec)
+			}
+			restore()
+		case iniDirInput:
+			restore := dec.withOptions(in.opts)
+			importConfigDir(values, in.path, &dec)
+			restore()
+		case dotenvInput:
+			importDotenvFile(values, in.path, &dec)
+		case jsonInput:
+			importJSONFile(values, in.path, &dec)
+		case tomlInput:
+			importTOMLFile(values, in.path, &dec)
+		case systemdInput:
+			importSystemdFile(values, in.path, &dec)
+		case processInput:
+			importProcessEnv(values, in.path, &dec)
+		case varInput:
+			importConfigVar(values, in.path, &dec)
+		}
 	}
 
 	if *configLast { // Append environment after loading config files
-		copyValues(values, parseEnv(assigned))
+		copyAssignments(values, assignedValues, assignedKeys, literalKeys)
 		importValues()
 	}
 
-	env := compileEnv(values, *dropRepeats, *keepFirst, *sep)
-	sort.Strings(env)
+	// Defaults have the lowest precedence of all, so they're applied once everything else is merged
+	copyDefaults(values, parseEnv(defaults), dec.casing, "-d")
 
-	argv := flag.Args()
-	if len(argv) == 0 {
-		for _, pair := range env {
-			io.WriteString(os.Stdout, pair+"\n")
+	// Appends given as -e K+=V extend whatever else was set for K, so they're added last
+	for _, pair := range appends {
+		idx := strings.IndexByte(pair, '=')
+		key, value := pair[:idx-1], pair[idx+1:]
+		if sep := listSep.forKey(key); sep != "" {
+			value = "+" + sep + value
 		}
-		return
+		addListValue(values, key, value, "-e")
 	}
 
-	cmd, err := exec.LookPath(argv[0])
-	if err != nil {
-		log(err)
-		os.Exit(127)
+	join := &joiner{
+		dropRepeats: *dropRepeats,
+		keepFirst:   *keepFirst,
+		dedup:       *dedup,
+		seps:        &sep,
+		strategies:  strategies,
+		order:       order,
+	}
+	applyListOps(values, join, &listSep, listOps, literals)
+	var expandAllow []keyPattern
+	if flagsSet["expand-only"] {
+		expandAllow = []keyPattern{}
+		for _, name := range expandOnly {
+			expandAllow = append(expandAllow, compilePattern(name, "expansion"))
+		}
 	}
+	expandValues(values, current, join, expandAllow, *calc)
 
-	argv[0] = cmd
+	if *templates {
+		renderTemplates(values, current, join, literals, *strict)
+	}
 
-	if err := syscall.Exec(cmd, argv, env); err != nil {
-		log("error exec-ing to <", cmd, ">: ", err)
-		os.Exit(126)
+	// Values are cased before booleans are normalized, so that normalized booleans are always lowercase
+	caseValues(values, &valueCasings)
+	if *normalizeBools {
+		normalizeBooleans(values)
 	}
 
-	log("exec failed, process still running")
-	os.Exit(1)
-}
+	if len(cleanPathKeys) > 0 {
+		cleanPaths(values, cleanPathKeys, join, &listSep, *cleanPathMissing)
+	}
 
-func compileEnv(src map[string][]string, dropRepeats, keepFirst bool, sep string) []string {
-	env := make([]string, 0, len(src))
-	for k, v := range src {
-		var pair string
-		if dropRepeats {
-			keptIndex := 0
-			if !keepFirst {
-				keptIndex = len(v) - 1
+	if *introspect {
+		setIntrospection(values, configFiles, listSep.forKey(configFilesVar))
+	}
+
+	// Exclusions take precedence over everything, so they're applied once the environment is fully merged
+	excludeKeys(values, excludes)
+
+	if missing := missingRequired(values, required, join); len(missing) > 0 {
+		for _, name := range missing {
+			logError("required variable not set: ", name)
+		}
+		os.Exit(exitUsage)
+	}
+
+	if *schemaFile != "" {
+		schema, err := readSchema(*schemaFile, &dec)
+		if err != nil {
+			fatal(exitFailure, "error reading schema <", *schemaFile, ">: ", err)
+		}
+		if unknown := unknownKeys(values, schema, current); len(unknown) > 0 && *strict {
+			for _, name := range unknown {
+				logError("variable not in schema: ", name)
 			}
-			pair = k + "=" + v[keptIndex]
+			os.Exit(exitUsage)
 		} else {
-			pair = k + "=" + strings.Join(v, sep)
+			for _, name := range unknown {
+				log("variable not in schema: ", name)
+			}
 		}
-		env = append(env, pair)
 	}
-	return env
-}
 
-func copyImports(dst map[string][]string, src map[string]string, imports Strings) {
-	for _, m := range imports {
-		if !strings.ContainsAny(m, "*?") {
-			copyLiteral(dst, src, m)
-			continue
+	if unset, invalid := checkValues(values, checks, join); len(unset)+len(invalid) > 0 {
+		for _, name := range unset {
+			logError("checked variable not set: ", name)
+		}
+		for _, name := range invalid {
+			logError("variable does not match its check: ", name)
 		}
+		os.Exit(exitUsage)
+	}
 
-		pat, err := compileWildcard(m)
-		if err != nil {
-			log("unable to compile pattern-like import", strconv.Quote(m), ": ", err)
-			copyLiteral(dst, src, m)
-			continue
+	if *explain != "" {
+		if err := writeExplain(os.Stdout, *explain, values, join); err != nil {
+			fatal(exitFailure, "error writing explanation: ", err)
 		}
+		return
+	}
 
-		for k, v := range src {
-			if _, ok := dst[k]; ok || !pat.MatchString(k) {
-				continue
+	outSep := dec.Separator
+	if *ksepOut != "" {
+		outSep = *ksepOut
+		renameSeparators(values, dec.Separator, outSep)
+	}
+
+	var counts *counter
+	if *count {
+		counts = &counter{sep: outSep, suffix: *countSuffix, all: *countAll}
+	}
+	var indexed *indexer
+	if len(indexedKeys) > 0 {
+		indexed = &indexer{sep: outSep}
+		for _, k := range indexedKeys {
+			indexed.patterns = append(indexed.patterns, compilePattern(k, "index"))
+		}
+	}
+	vars := compileEnv(values, join, *exportPrefix, counts, indexed)
+	if *dropEmpty {
+		vars = nonEmptyVars(vars)
+	}
+
+	if *posix {
+		var invalid []string
+		vars, invalid = posixVars(vars)
+		if len(invalid) > 0 && *strict {
+			for _, name := range invalid {
+				logError("invalid variable name: ", name)
 			}
-			dst[k] = []string{v}
+			os.Exit(exitUsage)
+		}
+		for _, name := range invalid {
+			log("skipping invalid variable name: ", name)
 		}
 	}
-}
 
-func copyLiteral(dst map[string][]string, src map[string]string, name string) {
-	if v, ok := src[name]; ok {
-		dst[name] = append(dst[name], v)
+	if *checkNUL || *strict {
+		if found := nulVars(vars); len(found) > 0 {
+			for _, desc := range found {
+				logError("variable contains NUL: ", desc)
+			}
+			os.Exit(exitDataErr)
+		}
 	}
-}
 
-func copyValues(dst map[string][]string, src map[string]string) {
-	for k, v := range src {
-		dst[k] = append(dst[k], v)
+	argv := flag.Args()
+	if len(argv) == 0 && dec.exec != "" {
+		if argv, err = splitWords(dec.exec); err != nil {
+			fatal(exitDataErr, "invalid exec setting: ", err)
+		}
+	}
+	if *shell && len(argv) > 0 {
+		argv = append([]string{*shellBin, "-c"}, argv...)
 	}
-}
 
-func parseEnv(environ []string) map[string]string {
-	env := map[string]string{}
-	for _, pair := range environ {
-		idx := strings.IndexByte(pair, '=')
-		if idx == -1 {
-			env[pair] = ""
-		} else {
-			env[pair[:idx]] = pair[idx+1:]
+	term := "\n"
+	if *nulTerminate {
+		term = "\x00"
+	}
+
+	if *hashEnv {
+		var sum string
+		vars, sum = hashVars(vars)
+		if len(argv) == 0 && *outFile == "" {
+			if _, err := fmt.Fprintln(os.Stdout, sum); err != nil {
+				fatal(exitFailure, "error writing hash: ", err)
+			}
+			return
 		}
+		vars = append(vars, envVar{key: hashVar, value: sum, values: []string{sum}})
+		sortVars(vars)
 	}
-	return env
-}
 
-func parseCasing(opt string) ini.KeyCase {
-	switch strings.ToLower(opt) {
-	case "", "s", "cs", "cased", "case-sensitive":
-	case "u", "up", "upper":
-		return ini.UpperCase
-	case "l", "d", "down", "lower":
-		return ini.LowerCase
-	default:
-		log("invalid case flag: ", strconv.Quote(opt), "; using default of \"case-sensitive\"")
+	// The output file gets the environment as it's passed to the command, without -grep or -mask applied
+	if *outFile != "" {
+		err := writeFileAtomic(*outFile, func(w io.Writer) error {
+			return writeFormat(w, format, vars, term, outSep, quote)
+		})
+		if err != nil {
+			fatal(exitFailure, "error writing environment to <", *outFile, ">: ", err)
+		}
+		if len(argv) == 0 {
+			return
+		}
 	}
-	return ini.CaseSensitive
-}
 
-func importConfigFile(dst map[string][]string, path string, dec *ini.Reader) {
-	var err error
-	var b []byte
+	if len(argv) == 0 {
+		if len(greps) > 0 {
+			vars = grepVars(vars, greps)
+		}
 
-	if path == "-" {
-		b, err = ioutil.ReadAll(os.Stdin)
-	} else {
-		b, err = ioutil.ReadFile(path)
+		// Diffs compare unmasked values, and mask them as they're written
+		if diff != noDiff {
+			if err := writeDiff(os.Stdout, vars, current, diff); err != nil {
+				fatal(exitFailure, "error writing environment: ", err)
+			}
+			return
+		}
+
+		if len(onlyPrefixes) > 0 {
+			vars = onlyVars(vars, onlyPrefixes)
+		}
+
+		if *namesOnly {
+			if err := writeNames(os.Stdout, vars, term); err != nil {
+				fatal(exitFailure, "error writing environment: ", err)
+			}
+			return
+		}
+
+		vars = maskVars(vars)
+
+		if err := writeFormat(os.Stdout, format, vars, term, outSep, quote); err != nil {
+			fatal(exitFailure, "error writing environment: ", err)
+		}
+		return
 	}
 
+	cmd, err := resolveCommand(argv[0], *dir, vars)
 	if err != nil {
-		log("error reading <", path, ">:", err)
+		fatal(exitNotFound, err)
+	}
+
+	// The resolved path is exec-ed, while argv[0] is what the command sees as its name
+	if *argv0 != "" {
+		argv[0] = *argv0
+	} else {
+		argv[0] = cmd
+	}
+
+	var cred *credential
+	if *runUser != "" || *runGroup != "" {
+		if cred, err = lookupCredential(*runUser, *runGroup); err != nil {
+			fatal(exitFailure, "error looking up user or group: ", err)
+		}
+	}
+
+	if *closeFDs || keepFDs != nil {
+		closeInheritedFDs(keepFDs)
+	}
+
+	if *dryRun {
+		if err := writePlan(os.Stderr, cmd, *dir, argv, maskVars(vars)); err != nil {
+			fatal(exitFailure, "error writing exec plan: ", err)
+		}
 		return
 	}
 
-	err = dec.Read(bytes.NewReader(b), ini.Values(dst))
-	if err != nil {
-		log("error parsing INI ", path, ": ", err)
+	// The lock is taken once all else is ready, and after -close-fds, so that its descriptor is kept across exec
+	var lock *os.File
+	if *lockFile != "" {
+		debug("acquiring lock on <", *lockFile, ">")
+		if lock, err = acquireLock(*lockFile, *lockWait); err == errLocked {
+			fatal(exitLocked, "error acquiring lock on <", *lockFile, ">: ", err)
+		} else if err != nil {
+			fatal(exitFailure, "error acquiring lock on <", *lockFile, ">: ", err)
+		}
+	}
+
+	if *wait {
+		opts := runOptions{
+			forward: forward,
+			reap:    *reapChildren,
+			dir:     *dir,
+			cred:    cred,
+			timeout: *runTimeout,
+			grace:   *grace,
+			setsid:  *setsid,
+		}
+		opts.stdout, opts.stderr = teeOutputs(*teeFile, *teeOut, *teeErr, *strict)
+		if opts.forward == nil {
+			opts.forward = defaultForwardedSignals
+		}
+		status, err := run(cmd, argv, environ(vars), opts)
+		if err != nil {
+			fatal(exitCannotExec, "error running <", cmd, ">: ", err)
+		}
+		if lock != nil { // Held until the command exits
+			lock.Close()
+		}
+		os.Exit(status)
+	}
+
+	// Config files have been loaded by now, so relative paths given to -f and others have already been resolved
+	if *dir != "" {
+		if err := os.Chdir(*dir); err != nil {
+			fatal(exitFailure, "error changing directory: ", err)
+		}
+	}
+
+	// binit can't fork to stop leading its process group, as setsid(1) does, so it's an error if it leads one
+	if *setsid {
+		if err := newSession(); err == syscall.EPERM {
+			fatal(exitFailure, "error starting a new session: binit is a process group leader (use -w to start one for the command)")
+		} else if err != nil {
+			fatal(exitFailure, "error starting a new session: ", err)
+		}
+	}
+
+	if cred != nil {
+		if err := setCredential(cred); err != nil {
+			fatal(exitFailure, "error dropping privileges: ", err)
+		}
+	}
+
+	// The command inherits the lock's descriptor, holding the lock until it exits
+	if lock != nil {
+		if err := inheritFD(lock.Fd()); err != nil {
+			fatal(exitFailure, "error keeping lock on <", *lockFile, ">: ", err)
+		}
+	}
+
+	if err := syscall.Exec(cmd, argv, environ(vars)); err != nil {
+		fatal(exitCannotExec, "error exec-ing to <", cmd, ">: ", err)
+	}
+
+	fatal(exitFailure, "exec failed, process still running")
+}
+
+// Separators is a flag.Value for multi-value separators. It holds a default separator and separators for keys
+// matching specific patterns, given as KEY=SEP.
+type Separators struct {
+	sep  string
+	keys []keySep
+}
+
+type keySep struct {
+	pat keyPattern
+	sep string
+}
+
+func (s *Separators) String() string {
+	return strconv.Quote(s.sep)
+}
+
+func (s *Separators) Set(str string) error {
+	s.set(str, unquoteSeparator)
+	return nil
+}
+
+func (s *Separators) set(str string, unquote func(string) string) {
+	if idx := strings.IndexByte(str, '='); idx != -1 {
+		s.keys = append(s.keys, keySep{
+			pat: compilePattern(str[:idx], "separator key"),
+			sep: unquote(str[idx+1:]),
+		})
+	} else {
+		s.sep = unquote(str)
+	}
+}
+
+// RawSeparators is a flag.Value that sets the separators of a Separators without unquoting them.
+type RawSeparators struct {
+	*Separators
+}
+
+func (s RawSeparators) String() string {
+	if s.Separators == nil {
+		return ""
+	}
+	return s.Separators.String()
+}
+
+func (s RawSeparators) Set(str string) error {
+	s.set(str, func(sep string) string { return sep })
+	return nil
+}
+
+// forKey returns the separator for key. If multiple patterns match key, the last one given takes precedence.
+func (s *Separators) forKey(key string) string {
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if s.keys[i].pat.match(key) {
+			return s.keys[i].sep
+		}
+	}
+	return s.sep
+}
+
+// unquoteSeparator unquotes s as a Go string, adding double quotes if s isn't already quoted. If s can't be unquoted,
+// it's returned as-is.
+func unquoteSeparator(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+
+	var err error
+	unquoted := s
+	// It's only going to be a valid Go quote if it starts with a character in ASCII range, so no need to worry about decoding a rune here.
+	switch s[0] {
+	case '`', '\'', '"':
+		unquoted, err = strconv.Unquote(s)
+	default:
+		unquoted, err = strconv.Unquote(`"` + strings.Replace(s, `"`, `\"`, -1) + `"`)
+	}
+	if err != nil {
+		log("unable to unquote separator: ", strconv.Quote(s))
+		return s
+	}
+	return unquoted
+}
+
+type mergeStrategy int
+
+const (
+	defaultMerge mergeStrategy = iota // Use -n and -N
+	firstMerge
+	lastMerge
+	minMerge
+	maxMerge
+	joinMerge
+)
+
+var mergeStrategies = map[string]mergeStrategy{
+	"first": firstMerge,
+	"last":  lastMerge,
+	"min":   minMerge,
+	"max":   maxMerge,
+	"join":  joinMerge,
+}
+
+// Strategies is a flag.Value for merge strategies of keys matching specific patterns, given as KEY=STRATEGY.
+type Strategies []keyStrategy
+
+type keyStrategy struct {
+	pat      keyPattern
+	strategy mergeStrategy
+}
+
+func (s *Strategies) String() string {
+	return "[]"
+}
+
+func (s *Strategies) Set(str string) error {
+	idx := strings.IndexByte(str, '=')
+	if idx == -1 {
+		return fmt.Errorf("expected KEY=STRATEGY, got %q", str)
+	}
+
+	strategy, ok := mergeStrategies[str[idx+1:]]
+	if !ok {
+		return fmt.Errorf("unknown merge strategy %q", str[idx+1:])
+	}
+
+	*s = append(*s, keyStrategy{
+		pat:      compilePattern(str[:idx], "merge strategy key"),
+		strategy: strategy,
+	})
+	return nil
+}
+
+// joiner collapses the values recorded for a key into the single value passed to the child.
+type joiner struct {
+	dropRepeats bool
+	keepFirst   bool
+	dedup       bool // Drop duplicate values, keeping the first of each
+	seps        *Separators
+	strategies  []keyStrategy // Strategies for specific keys. Later strategies take precedence.
+	order       sortOrder     // The order multi-value keys are sorted in when compiled.
+}
+
+// kept returns the values of v that are kept for key once duplicates and repeats are dropped, if enabled.
+func (j *joiner) kept(key string, v []string) []string {
+	if j.dedup && len(v) > 1 {
+		v = uniqueValues(v)
+	}
+	if len(v) < 2 {
+		return v
+	}
+
+	switch j.strategy(key) {
+	case firstMerge:
+		return v[:1]
+	case lastMerge:
+		return v[len(v)-1:]
+	case minMerge, maxMerge:
+		return extremeValue(key, v, j.strategy(key) == maxMerge)
+	case joinMerge:
+		return v
+	}
+
+	if j.dropRepeats {
+		keptIndex := 0
+		if !j.keepFirst {
+			keptIndex = len(v) - 1
+		}
+		return v[keptIndex : keptIndex+1]
+	}
+	return v
+}
+
+func (j *joiner) join(key string, v []string) string {
+	return strings.Join(j.kept(key, v), j.seps.forKey(key))
+}
+
+// strategy returns the merge strategy for key.
+func (j *joiner) strategy(key string) mergeStrategy {
+	for i := len(j.strategies) - 1; i >= 0; i-- {
+		if j.strategies[i].pat.match(key) {
+			return j.strategies[i].strategy
+		}
+	}
+	return defaultMerge
+}
+
+// extremeValue returns the least or, if greatest is true, greatest integer value in v. If any value of v isn't an
+// integer, the last value of v is returned instead.
+func extremeValue(key string, v []string, greatest bool) []string {
+	best, bestN := 0, int64(0)
+	for i, s := range v {
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 0, 64)
+		if err != nil && isMasked(key) {
+			log("unable to compare values of ", key, " as integers; using last value")
+			return v[len(v)-1:]
+		} else if err != nil {
+			log("unable to compare values of ", key, " as integers; using last value: ", err)
+			return v[len(v)-1:]
+		}
+		if i == 0 || (greatest && n > bestN) || (!greatest && n < bestN) {
+			best, bestN = i, n
+		}
+	}
+	return v[best : best+1]
+}
+
+// sortOrder is a flag.Value for the order values of multi-value keys are sorted in (-sort-values). Given without a value,
+// values are sorted lexically.
+type sortOrder string
+
+const (
+	unsorted    sortOrder = ""
+	lexicalSort sortOrder = "lexical"
+	numericSort sortOrder = "numeric"
+)
+
+func (o *sortOrder) String() string {
+	return string(*o)
+}
+
+func (o *sortOrder) Set(str string) error {
+	switch next := sortOrder(str); next {
+	case "true", lexicalSort:
+		*o = lexicalSort
+	case "false":
+		*o = unsorted
+	case numericSort:
+		*o = next
+	default:
+		return fmt.Errorf("unknown sort order %q", str)
+	}
+	return nil
+}
+
+func (o *sortOrder) IsBoolFlag() bool {
+	return true
+}
+
+// sortValues returns a sorted copy of v. Under numericSort, values that are numbers sort before those that aren't, and
+// values that aren't numbers are sorted lexically.
+func sortValues(v []string, order sortOrder) []string {
+	sorted := append([]string(nil), v...)
+	if order != numericSort {
+		sort.Strings(sorted)
+		return sorted
+	}
+
+	sort.SliceStable(sorted, func(a, b int) bool {
+		x, xerr := strconv.ParseFloat(strings.TrimSpace(sorted[a]), 64)
+		y, yerr := strconv.ParseFloat(strings.TrimSpace(sorted[b]), 64)
+		switch {
+		case xerr == nil && yerr == nil:
+			return x < y
+		case xerr == nil || yerr == nil:
+			return xerr == nil
+		default:
+			return sorted[a] < sorted[b]
+		}
+	})
+	return sorted
+}
+
+// envVar is a variable as it's passed to the child.
+type envVar struct {
+	key    string
+	value  string
+	values []string // The values joined to produce value.
+	masked bool     // Whether value is masked when printed.
+}
+
+func (v envVar) pair() string {
+	return v.key + "=" + v.value
+}
+
+// uniqueValues returns the values of v without duplicates, in order of their first occurrence.
+func uniqueValues(v []string) []string {
+	seen := make(map[string]bool, len(v))
+	unique := make([]string, 0, len(v))
+	for _, s := range v {
+		if !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
+
+// counter configures the companion variables holding the number of values of each key (-count).
+type counter struct {
+	sep    string // The key separator inserted before suffix.
+	suffix string
+	all    bool // Whether to count keys with a single value.
+}
+
+// indexer configures the keys whose values are set as one variable per value instead of joined (-indexed).
+type indexer struct {
+	patterns []keyPattern
+	sep      string // The key separator inserted before each index.
+}
+
+// match returns whether key is indexed. A nil indexer matches no keys.
+func (ix *indexer) match(key string) bool {
+	if ix == nil {
+		return false
+	}
+	for _, p := range ix.patterns {
+		if p.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileEnv collapses the values of src into variables, sorted by their KEY=value pairs or, under -preserve-order, in
+// the order their keys were first set. Each key is prefixed with prefix. If counts is not nil, a KEY<sep><suffix>
+// variable holding the number of values is added for each key with more than one value, or every key if counts.all is
+// set, unless src already sets that key. Keys matched by indexed are set as a KEY<sep><N> variable for each value,
+// counting from 0, instead of a single KEY variable, skipping any that src already sets.
+func compileEnv(src map[string][]string, j *joiner, prefix string, counts *counter, indexed *indexer) []envVar {
+	vars := make([]envVar, 0, len(src))
+	for _, k := range orderedKeys(src) {
+		kept := j.kept(k, src[k])
+		if j.order != unsorted && len(kept) > 1 {
+			kept = sortValues(kept, j.order)
+		}
+		if indexed.match(k) {
+			for i, v := range kept {
+				indexKey := k + indexed.sep + strconv.Itoa(i)
+				if _, ok := src[indexKey]; ok {
+					log("not setting ", indexKey, " to value ", i, " of ", k, ": already set")
+					continue
+				}
+				vars = append(vars, envVar{key: prefix + indexKey, value: v, values: []string{v}, masked: isMasked(k)})
+			}
+		} else {
+			vars = append(vars, envVar{
+				key:    prefix + k,
+				value:  strings.Join(kept, j.seps.forKey(k)),
+				values: kept,
+				masked: isMasked(k),
+			})
+		}
+
+		if counts == nil || (len(kept) < 2 && !counts.all) {
+			continue
+		}
+		countKey := k + counts.sep + counts.suffix
+		if _, ok := src[countKey]; ok {
+			log("not setting ", countKey, " to the number of values of ", k, ": already set")
+			continue
+		}
+		n := strconv.Itoa(len(kept))
+		vars = append(vars, envVar{key: prefix + countKey, value: n, values: []string{n}})
+	}
+	sortVars(vars)
+	return vars
+}
+
+// nonEmptyVars returns the vars whose values aren't empty, so that variables set to empty values are unset instead.
+func nonEmptyVars(vars []envVar) []envVar {
+	kept := vars[:0]
+	for _, v := range vars {
+		if v.value == "" {
+			debug("dropping empty variable ", v.key)
+			continue
+		}
+		kept = append(kept, v)
+	}
+	return kept
+}
+
+// hashVar is the variable that holds the hash of the environment under -hash.
+const hashVar = "BINIT_CONFIG_HASH"
+
+// hashVars returns the hex-encoded SHA-256 hash of the sorted KEY=value pairs of vars, each terminated by a NUL byte,
+// along with vars less any hashVar, which isn't hashed. The pairs are sorted even when vars isn't (-preserve-order), so
+// the hash doesn't depend on the order in which keys were set.
+func hashVars(vars []envVar) ([]envVar, string) {
+	hashed := vars[:0]
+	pairs := make([]string, 0, len(vars))
+	for _, v := range vars {
+		if v.key == hashVar {
+			continue
+		}
+		pairs = append(pairs, v.pair())
+		hashed = append(hashed, v)
+	}
+	sort.Strings(pairs)
+
+	h := sha256.New()
+	for _, pair := range pairs {
+		io.WriteString(h, pair+"\x00")
+	}
+	return hashed, hex.EncodeToString(h.Sum(nil))
+}
+
+// Variables set by -introspect.
+const (
+	argvVar        = "BINIT_ARGV"
+	cwdVar         = "BINIT_CWD"
+	configFilesVar = "BINIT_CONFIG_FILES"
+)
+
+// setIntrospection sets variables in src describing how binit was run: its command line, with each argument quoted for
+// a POSIX shell where needed, its working directory, and files, the config files it loaded, joined by listSep. Each
+// replaces any values already set for its key. Values are set after expansion, so they're used as-is.
+func setIntrospection(src map[string][]string, files []string, listSep string) {
+	args := make([]string, len(os.Args))
+	for i, arg := range os.Args {
+		args[i] = shellWord(arg)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		log("unable to get working directory for ", cwdVar, ": ", err)
+	}
+
+	for _, kv := range [][2]string{
+		{argvVar, strings.Join(args, " ")},
+		{cwdVar, cwd},
+		{configFilesVar, strings.Join(files, listSep)},
+	} {
+		key := canonicalKey(kv[0])
+		if len(src[key]) > 0 {
+			delete(src, key)
+			replaceOrigins(key)
+		}
+		addValue(src, key, kv[1], "-introspect")
+	}
+}
+
+// absPath returns the absolute path of path, if it names a file, or else path itself.
+func absPath(path string) string {
+	if !isLocalPath(path) {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// environ returns the KEY=value pairs of vars.
+func environ(vars []envVar) []string {
+	env := make([]string, len(vars))
+	for i, v := range vars {
+		env[i] = v.pair()
+	}
+	return env
+}
+
+// applyListOps resolves list operations in the values of src, in place. A value beginning with + and the list
+// separator for its key appends the rest of the value to the key's earlier values, joined by j, using the separator.
+// Similarly, a value ending with the separator and + prepends the rest of the value. If the key has no earlier values,
+// the rest of the value is used alone. Only values marked in ops, by their keys and indices, are operations.
+//
+// The indices of values marked in literal are updated to match, where a value resolved from any literal value is
+// literal.
+func applyListOps(src map[string][]string, j *joiner, listSeps *Separators, ops, literal map[string]map[int]bool) {
+	for k, v := range src {
+		sep := listSeps.forKey(k)
+		if sep == "" || len(ops[k]) == 0 {
+			continue
+		}
+
+		lit := make([]bool, len(v))
+		for i := range lit {
+			lit[i] = literal[k][i]
+		}
+
+		// Indices into the original values, since resolving an operation replaces the values preceding it
+		offset := 0
+		for i := 0; i < len(v); i++ {
+			if !ops[k][i+offset] {
+				continue
+			}
+
+			var value, prior string
+			appending := strings.HasPrefix(v[i], "+"+sep)
+			if appending {
+				value = v[i][len(sep)+1:]
+			} else if strings.HasSuffix(v[i], sep+"+") {
+				value = v[i][:len(v[i])-len(sep)-1]
+			} else {
+				continue
+			}
+
+			if i > 0 {
+				prior = j.join(k, v[:i])
+			}
+			if prior != "" && appending {
+				value = prior + sep + value
+			} else if prior != "" {
+				value = value + sep + prior
+			}
+
+			// Replace the earlier values and the operation with the result
+			merged := false
+			for _, l := range lit[:i+1] {
+				merged = merged || l
+			}
+			v = append([]string{value}, v[i+1:]...)
+			lit = append([]bool{merged}, lit[i+1:]...)
+			offset += i
+			i = 0
+		}
+		src[k] = v
+
+		delete(literal, k)
+		for i, l := range lit {
+			if !l {
+				continue
+			}
+			if literal[k] == nil {
+				literal[k] = map[int]bool{}
+			}
+			literal[k][i] = true
+		}
+	}
+}
+
+// cleanPaths replaces the values of each key of src matching a pattern in keys with a single value, their merged value
+// with duplicate list entries removed, keeping the first of each. Entries are split by the key's -l list separator.
+// If dropMissing is set, entries naming directories that don't exist are removed as well, where an empty entry names
+// the current directory.
+func cleanPaths(src map[string][]string, keys []string, j *joiner, listSeps *Separators, dropMissing bool) {
+	pats := make([]keyPattern, len(keys))
+	for i, k := range keys {
+		pats[i] = compilePattern(k, "clean path key")
+	}
+
+	for k, v := range src {
+		matched := false
+		for _, pat := range pats {
+			if matched = pat.match(k); matched {
+				break
+			}
+		}
+		sep := listSeps.forKey(k)
+		if !matched || sep == "" {
+			continue
+		}
+
+		seen := map[string]bool{}
+		var entries []string
+		for _, dir := range strings.Split(j.join(k, v), sep) {
+			if seen[dir] {
+				continue
+			}
+			seen[dir] = true
+
+			if dropMissing {
+				path := dir
+				if path == "" {
+					path = "."
+				}
+				if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+					debug("dropping ", strconv.Quote(dir), " from ", k, ": not a directory")
+					continue
+				}
+			}
+			entries = append(entries, dir)
+		}
+		src[k] = []string{strings.Join(entries, sep)}
+	}
+}
+
+// ValueCasings is a flag.Value for case transformations of values. It holds a default transformation and
+// transformations for keys matching specific patterns, given as KEY=MODE.
+type ValueCasings struct {
+	mode caseMode
+	keys []keyValueCasing
+}
+
+type keyValueCasing struct {
+	pat  keyPattern
+	mode caseMode
+}
+
+func (c *ValueCasings) String() string {
+	return "none"
+}
+
+func (c *ValueCasings) Set(str string) error {
+	mode, pat := str, ""
+	if idx := strings.IndexByte(str, '='); idx != -1 {
+		pat, mode = str[:idx], str[idx+1:]
+	}
+
+	var m caseMode
+	switch strings.ToLower(mode) {
+	case "u", "up", "upper":
+		m = upperCase
+	case "l", "d", "down", "lower":
+		m = lowerCase
+	case "n", "none":
+		m = caseSensitive
+	default:
+		return fmt.Errorf("unknown value case %q", mode)
+	}
+
+	if pat == "" {
+		c.mode = m
+	} else {
+		c.keys = append(c.keys, keyValueCasing{pat: compilePattern(pat, "value case key"), mode: m})
+	}
+	return nil
+}
+
+// forKey returns the case transformation for the values of key. If multiple patterns match key, the last one given
+// takes precedence.
+func (c *ValueCasings) forKey(key string) caseMode {
+	for i := len(c.keys) - 1; i >= 0; i-- {
+		if c.keys[i].pat.match(key) {
+			return c.keys[i].mode
+		}
+	}
+	return c.mode
+}
+
+// caseValues transforms the case of each value in src according to casings.
+func caseValues(src map[string][]string, casings *ValueCasings) {
+	for k, v := range src {
+		var fn func(string) string
+		switch casings.forKey(k) {
+		case upperCase:
+			fn = strings.ToUpper
+		case lowerCase:
+			fn = strings.ToLower
+		default:
+			continue
+		}
+		for i, s := range v {
+			v[i] = fn(s)
+		}
+	}
+}
+
+var booleans = map[string]string{
+	"1":     "true",
+	"true":  "true",
+	"yes":   "true",
+	"on":    "true",
+	"0":     "false",
+	"false": "false",
+	"no":    "false",
+	"off":   "false",
+}
+
+// normalizeBooleans replaces each value in src that's recognized as a boolean, ignoring case, with true or false.
+func normalizeBooleans(src map[string][]string) {
+	for _, v := range src {
+		for i, s := range v {
+			if b, ok := booleans[strings.ToLower(s)]; ok {
+				v[i] = b
+			}
+		}
+	}
+}
+
+// dropInherited deletes variables from the inherited environment env that match any of the patterns in drops.
+func dropInherited(env map[string]string, drops Strings) {
+	for _, x := range drops {
+		pat := compilePattern(x, "drop")
+		for k := range env {
+			if pat.match(k) {
+				delete(env, k)
+			}
+		}
+	}
+}
+
+// renameSeparators replaces each occurrence of the key separator from with to in the keys of src. If a renamed key is
+// already set, the renamed key's values are added to it.
+func renameSeparators(src map[string][]string, from, to string) {
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		if strings.Contains(k, from) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		renamed := strings.Replace(k, from, to, -1)
+		if n := len(src[renamed]); n > 0 {
+			debug("rename ", k, " to ", renamed, " after ", n, " earlier value(s)")
+		}
+		if _, ok := keyOrder[renamed]; !ok && keyOrder != nil {
+			keyOrder[renamed] = keyOrder[k]
+		}
+		src[renamed] = append(src[renamed], src[k]...)
+		delete(src, k)
+	}
+}
+
+// excludeKeys deletes keys from src that match any of the patterns in excludes.
+func excludeKeys(src map[string][]string, excludes Strings) {
+	for _, x := range excludes {
+		pat := compilePattern(x, "exclusion")
+		if pat.literal() {
+			delete(src, lookupKey(x))
+			continue
+		}
+
+		for k := range src {
+			if pat.match(k) {
+				delete(src, k)
+			}
+		}
+	}
+}
+
+// copyImports copies the variables of src named by imports to dst, renamed by rename. An import given as SRC:DST
+// copies SRC as DST instead, without rename. If SRC contains wildcards, DST may refer to the text matched by each
+// wildcard as $1, $2, and so on, in the order they appear in SRC.
+func copyImports(dst map[string][]string, src map[string]string, imports Strings, rename func(string) string) {
+	for _, m := range imports {
+		target, renamed := "", false
+		if idx := strings.IndexByte(m, ':'); idx != -1 {
+			m, target, renamed = m[:idx], m[idx+1:], true
+		}
+
+		pat := compilePattern(m, "import")
+		if pat.literal() && renamed {
+			copyLiteral(dst, src, m, target, "environment")
+			continue
+		} else if pat.literal() {
+			copyLiteral(dst, src, m, rename(m), "environment")
+			continue
+		}
+
+		for k, v := range src {
+			if !pat.match(k) {
+				continue
+			}
+			var name string
+			if renamed {
+				name = string(pat.re.ExpandString(nil, target, k, pat.re.FindStringSubmatchIndex(k)))
+			} else {
+				name = rename(k)
+			}
+			name = canonicalKey(name)
+			if _, ok := dst[name]; ok {
+				continue
+			}
+			addLiteralValue(dst, name, v, "environment")
+		}
+	}
+}
+
+func copyLiteral(dst map[string][]string, src map[string]string, name, target, source string) {
+	if v, ok := src[name]; ok {
+		addLiteralValue(dst, target, v, source)
+	}
+}
+
+// stripPrefix returns key without prefix, cased according to casing, if key begins with prefix. If key doesn't begin
+// with prefix or is only the prefix, it's returned unchanged.
+func stripPrefix(key, prefix string, casing keyCasing) string {
+	if prefix == "" || len(key) <= len(prefix) || !strings.HasPrefix(key, prefix) {
+		return key
+	}
+	return casing.apply(key[len(prefix):])
+}
+
+// copyLists adds the values of src to dst using addValue, in sorted order of their keys.
+func copyLists(dst map[string][]string, src map[string][]string, source string) {
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range src[k] {
+			addValue(dst, k, v, source)
+		}
+	}
+}
+
+// copyValues adds the values of src to dst as literal values, in sorted order of their keys.
+func copyValues(dst map[string][]string, src map[string]string, source string) {
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		addLiteralValue(dst, k, src[k], source)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// foldedKeys maps keys, folded to lowercase, to the casing each key was first seen with. If not nil, keys that differ
+// only in case are merged as the same key (-ci).
+var foldedKeys map[string]string
+
+// canonicalKey returns the key that key is merged as. Unless keys are folded, this is key itself.
+func canonicalKey(key string) string {
+	if foldedKeys == nil {
+		return key
+	}
+	folded := strings.ToLower(key)
+	if k, ok := foldedKeys[folded]; ok {
+		return k
+	}
+	foldedKeys[folded] = key
+	return key
+}
+
+// lookupKey returns the key that name refers to when keys are folded, or name if no key differing from it only in case
+// has been set. Unlike canonicalKey, it doesn't record name as a key.
+func lookupKey(name string) string {
+	if k, ok := foldedKeys[strings.ToLower(name)]; ok {
+		return k
+	}
+	return name
+}
+
+// addValue appends value to the values of key in dst. source describes where the value came from when logged under
+// -v.
+func addValue(dst map[string][]string, key, value, source string) {
+	key = canonicalKey(key)
+	if n := len(dst[key]); n > 0 {
+		debug(source, ": set ", key, "=", strconv.Quote(maskValue(key, value)), " after ", n, " earlier value(s)")
+	} else {
+		debug(source, ": set ", key, "=", strconv.Quote(maskValue(key, value)))
+	}
+	dst[key] = append(dst[key], value)
+	recordKey(key)
+	recordOrigin(key, value, source)
+}
+
+// listOps holds, for each key, the indices of its values that may be list operations (see applyListOps). Only values
+// set by -e and INI files may be, so that values taken literally, such as those inherited from the environment or read
+// by -e NAME=@FILE, are never rewritten.
+var listOps = map[string]map[int]bool{}
+
+// addListValue adds value to the values of key in dst, as addValue does, and marks it as a possible list operation.
+func addListValue(dst map[string][]string, key, value, source string) {
+	addValue(dst, key, value, source)
+	markLast(listOps, dst, key)
+}
+
+// literals holds, for each key, the indices of its values that are taken literally, such as those inherited from the
+// environment or read by -e NAME=@FILE. Besides being escaped from expansion, they aren't rendered as templates (-T).
+var literals = map[string]map[int]bool{}
+
+// addLiteralValue adds value to the values of key in dst, as addValue does, and marks it as literal.
+func addLiteralValue(dst map[string][]string, key, value, source string) {
+	addValue(dst, key, value, source)
+	markLast(literals, dst, key)
+}
+
+// markLast marks the last value of key in dst in marks.
+func markLast(marks map[string]map[int]bool, dst map[string][]string, key string) {
+	key = canonicalKey(key)
+	if marks[key] == nil {
+		marks[key] = map[int]bool{}
+	}
+	marks[key][len(dst[key])-1] = true
+}
+
+// copyAssignments adds the values of src, set by -e and -ef, to dst in the order of keys. Values of keys other than
+// those in literal may be list operations.
+func copyAssignments(dst map[string][]string, src map[string]string, keys []string, literal map[string]bool) {
+	for _, k := range keys {
+		if literal[k] {
+			addLiteralValue(dst, k, src[k], "-e")
+		} else {
+			addListValue(dst, k, src[k], "-e")
+		}
+	}
+}
+
+// keyOrder maps each key to the order it was first set in, if not nil (-preserve-order).
+var keyOrder map[string]int
+
+func recordKey(key string) {
+	if _, ok := keyOrder[key]; !ok && keyOrder != nil {
+		keyOrder[key] = len(keyOrder)
+	}
+}
+
+// orderedKeys returns the keys of src in the order they were first set, if keyOrder is recorded, followed by any keys
+// it doesn't hold. Otherwise, or among keys that weren't recorded, keys are sorted.
+func orderedKeys(src map[string][]string) []string {
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		ra, oka := keyOrder[keys[a]]
+		rb, okb := keyOrder[keys[b]]
+		if oka != okb {
+			return oka
+		} else if oka && ra != rb {
+			return ra < rb
+		}
+		return keys[a] < keys[b]
+	})
+	return keys
+}
+
+// sortVars sorts vars by their KEY=value pairs, unless keys are kept in the order they were set (-preserve-order).
+func sortVars(vars []envVar) {
+	if keyOrder != nil {
+		return
+	}
+	sort.Slice(vars, func(a, b int) bool {
+		return vars[a].pair() < vars[b].pair()
+	})
+}
+
+// fileValues is an ini.Recorder that collects the values read from a file, with keys cased according to casing. Keys
+// are kept in the order they first appear.
+//
+// A key ending in + (as in "key+ = value") appends to the key's earlier values. If replace is set, a key without
+// a trailing + replaces the values set for it before the file was loaded.
+//
+// Keys in the [binit] section are collected as settings instead, keyed by their names in the section.
+type fileValues struct {
+	keys     []string
+	values   map[string][]string
+	casing   keyCasing
+	replace  bool
+	replaces map[string]bool
+
+	settingsSep string // The key separator, used to find keys in the [binit] section.
+	settings    map[string]string
+	includes    []string // Files included by the [binit] section, in order.
+
+	// sections, if not nil, are the patterns of the sections whose keys are added. Others are skipped.
+	sections []keyPattern
+
+	// lookup returns the value of a variable named in the condition of a [binit.if COND] section. If nil, conditions
+	// aren't evaluated, and the keys of conditional sections are always added.
+	lookup func(name string) (string, bool)
+}
+
+func (f *fileValues) Add(key, value string) {
+	if prefix := binitSection + f.settingsSep; len(key) > len(prefix) && strings.EqualFold(key[:len(prefix)], prefix) {
+		name := strings.ToLower(key[len(prefix):])
+		if name == includeSetting {
+			f.includes = append(f.includes, value)
+			return
+		}
+		cond, rest, ok := splitCondition(key[len(prefix):], f.settingsSep)
+		if !ok {
+			if f.settings == nil {
+				f.settings = map[string]string{}
+			}
+			f.settings[name] = value
+			return
+		}
+
+		if f.lookup != nil {
+			met, err := evalCondition(cond, f.lookupVar)
+			if err != nil {
+				log("invalid condition in [", binitSection, f.settingsSep, "if ", cond, "]: ", err)
+				return
+			} else if !met {
+				debug("skipping ", rest, ": condition ", strconv.Quote(cond), " not met")
+				return
+			}
+		}
+		key = rest
+	}
+
+	if f.sections != nil && !inSection(key, f.settingsSep, f.sections) {
+		debug("skipping ", key, ": not in a -section")
+		return
+	}
+
+	appended := strings.HasSuffix(key, "+")
+	key = f.casing.apply(strings.TrimSuffix(key, "+"))
+	if _, ok := f.values[key]; !ok {
+		f.keys = append(f.keys, key)
+	}
+	f.values[key] = append(f.values[key], value)
+
+	if f.replace && !appended {
+		if f.replaces == nil {
+			f.replaces = map[string]bool{}
+		}
+		f.replaces[key] = true
+	}
+}
+
+// lookupVar returns the last value of the variable name read from the file so far, or else the value passed to
+// f.lookup.
+func (f *fileValues) lookupVar(name string) (string, bool) {
+	if v := f.values[name]; len(v) > 0 {
+		return v[len(v)-1], true
+	}
+	return f.lookup(name)
+}
+
+// copyTo adds the collected values to dst using addValue.
+func (f *fileValues) copyTo(dst map[string][]string, source string) {
+	for _, k := range f.keys {
+		if ck := canonicalKey(k); f.replaces[k] && len(dst[ck]) > 0 {
+			debug(source, ": replace ", len(dst[ck]), " earlier value(s) of ", ck)
+			delete(dst, ck)
+			delete(listOps, ck)
+			delete(literals, ck)
+			replaceOrigins(ck)
+		}
+		for _, v := range f.values[k] {
+			addListValue(dst, k, v, source)
+		}
+	}
+}
+
+// copyDefaults copies the values of src to dst for keys that dst doesn't already hold. Keys are cased according to
+// casing before they're checked.
+func copyDefaults(dst map[string][]string, src map[string]string, casing keyCasing, source string) {
+	for k, v := range src {
+		k = canonicalKey(casing.apply(k))
+		if _, ok := dst[k]; !ok {
+			addValue(dst, k, v, source)
+		}
+	}
+}
+
+// splitAppends separates the assignments in pairs of the form KEY+=value from all others.
+func splitAppends(pairs []string) (sets, appends []string) {
+	for _, pair := range pairs {
+		if idx := strings.IndexByte(pair, '='); idx > 1 && pair[idx-1] == '+' {
+			appends = append(appends, pair)
+		} else {
+			sets = append(sets, pair)
+		}
+	}
+	return sets, appends
+}
+
+// readAssignments returns the KEY=value pairs read from each file in paths, one per line, in the order they're read, as
+// they'd be passed to -e. Blank lines are skipped.
+func readAssignments(paths []string, dec *configReader) []string {
+	var lines []string
+	for _, path := range paths {
+		b, err := dec.readInput(path)
+		if err != nil {
+			dec.fail(exitFailure, "error reading <", path, ">: ", err)
+			continue
+		}
+
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSuffix(line, "\r"); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+// readAssignedFiles replaces each value in env beginning with @ with the contents of the file it names, less a single
+// trailing newline. File contents are escaped so that they aren't subject to expansion. A value beginning with @@ is
+// unescaped to a value beginning with a single @ instead.
+//
+// A value of the form keyring:SERVICE/ACCOUNT is replaced with the secret stored in the OS keyring, escaped the same
+// way, and its key is masked.
+//
+// The keys of values read from files or the keyring are returned as literal, since those values are taken as-is.
+func readAssignedFiles(env map[string]string) (map[string]string, map[string]bool, error) {
+	literal := map[string]bool{}
+	for k, v := range env {
+		if strings.HasPrefix(v, keyringScheme) {
+			secret, err := readKeyring(v[len(keyringScheme):])
+			if err != nil {
+				return nil, nil, fmt.Errorf("error reading value of %s from keyring: %v", k, err)
+			}
+			env[k] = escapeValue(secret)
+			literal[k] = true
+			masks = append(masks, keyPattern{name: k})
+			continue
+		} else if !strings.HasPrefix(v, "@") {
+			continue
+		} else if strings.HasPrefix(v, "@@") {
+			env[k] = v[1:]
+			continue
+		}
+
+		b, err := ioutil.ReadFile(v[1:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading value of %s from <%s>: %v", k, v[1:], err)
+		}
+		b = bytes.TrimSuffix(b, []byte("\n"))
+		env[k] = escapeValue(string(b))
+		literal[k] = true
+	}
+	return env, literal, nil
+}
+
+// keyringScheme prefixes -e values read from the OS keyring.
+const keyringScheme = "keyring:"
+
+// readKeyring returns the secret named by ref, given as SERVICE/ACCOUNT, from the OS keyring.
+func readKeyring(ref string) (string, error) {
+	idx := strings.IndexByte(ref, '/')
+	if idx <= 0 || idx == len(ref)-1 {
+		return "", fmt.Errorf("invalid reference %q: must be SERVICE/ACCOUNT", ref)
+	}
+	return keyringSecret(ref[:idx], ref[idx+1:])
+}
+
+// parseEnv returns the values of the KEY=value pairs of environ. Later pairs take precedence over earlier pairs with the
+// same key.
+func parseEnv(environ []string) map[string]string {
+	env := map[string]string{}
+	for _, pair := range environ {
+		idx := strings.IndexByte(pair, '=')
+		if idx == -1 {
+			env[pair] = ""
+		} else {
+			env[pair[:idx]] = pair[idx+1:]
+		}
+	}
+	return env
+}
+
+// pairKeys returns the keys of the KEY=value pairs of environ, in the order each key first appears.
+func pairKeys(environ []string) []string {
+	seen := make(map[string]bool, len(environ))
+	keys := make([]string, 0, len(environ))
+	for _, pair := range environ {
+		key := pair
+		if idx := strings.IndexByte(pair, '='); idx != -1 {
+			key = pair[:idx]
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// parseCasing parses a comma-separated list of case transformations, to be applied in order. Invalid transformations
+// are logged and skipped.
+func parseCasing(opt string) []caseMode {
+	var modes []caseMode
+	for _, name := range strings.Split(opt, ",") {
+		if mode := parseCaseMode(strings.TrimSpace(name)); mode != caseSensitive {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+func parseCaseMode(opt string) caseMode {
+	switch strings.ToLower(opt) {
+	case "", "c", "s", "cs", "cased", "case-sensitive":
+	case "u", "up", "upper":
+		return upperCase
+	case "l", "d", "down", "lower":
+		return lowerCase
+	case "t", "title":
+		return titleCase
+	case "e", "env", "snake-to-env":
+		return envCase
+	default:
+		log("invalid case flag: ", strconv.Quote(opt), "; ignoring it")
+	}
+	return caseSensitive
+}
+
+// readInput reads the contents of the file at path, or of standard input if path is "-". If path is an http or https
+// URL, its contents are fetched instead.
+func (dec *configReader) readInput(path string) ([]byte, error) {
+	if path == "-" && dec.eofMarker != "" {
+		return readUntilMarker(os.Stdin, dec.eofMarker)
+	} else if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return dec.fetchURL(path)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// readUntilMarker reads lines from r up to a line equal to marker, returning the lines before it. r is read a byte at
+// a time so that nothing after the marker is consumed, leaving it to be read by the command. It's an error if r ends
+// before the marker.
+func readUntilMarker(r io.Reader, marker string) ([]byte, error) {
+	var data, line []byte
+	c := make([]byte, 1)
+	for {
+		n, err := r.Read(c)
+		if n == 1 {
+			line = append(line, c[0])
+			if c[0] != '\n' {
+				continue
+			}
+			if string(bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})) == marker {
+				return data, nil
+			}
+			data, line = append(data, line...), line[:0]
+			continue
+		}
+		if err == io.EOF && string(bytes.TrimSuffix(line, []byte{'\r'})) == marker {
+			return data, nil
+		} else if err == io.EOF {
+			return nil, fmt.Errorf("end of input before %q", marker)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fetchURL returns the body of a GET request for url, retrying failed requests up to dec.retries times. The delay
+// between attempts starts at dec.retryDelay and doubles after each one.
+func (dec *configReader) fetchURL(url string) ([]byte, error) {
+	delay := dec.retryDelay
+	for attempt := 1; ; attempt++ {
+		b, err := fetchURL(url, dec.timeout)
+		if err == nil || attempt > dec.retries {
+			return b, err
+		}
+
+		debug("attempt ", attempt, " to fetch <", url, "> failed: ", err, "; retrying in ", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// fetchURL returns the body of a GET request for url. Responses other than 200 OK are errors.
+func fetchURL(url string, timeout time.Duration) ([]byte, error) {
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// globInput returns the files matching path, in sorted order, if path contains wildcards (*, ?, or [). Otherwise, or if
+// path is standard input, a URL, or names a file that exists, it returns only path.
+func globInput(path string, dec *configReader) []string {
+	if !isLocalPath(path) || !strings.ContainsAny(path, "*?[") {
+		return []string{path}
+	}
+
+	// A file whose name only looks like a pattern, such as "app[1].ini", is loaded as it's named
+	if _, err := os.Stat(path); err == nil {
+		return []string{path}
+	}
+
+	// A malformed pattern is taken as a literal path, as it would've been before patterns were supported
+	matches, err := filepath.Glob(path)
+	if err != nil {
+		return []string{path}
+	}
+	if len(matches) == 0 {
+		dec.fail(exitFailure, "no files match ", strconv.Quote(path))
+		return nil
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// gunzip returns the decompressed contents of b if it begins with the gzip magic number. Otherwise, b is returned as-is.
+func gunzip(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		return b, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// importConfigDir loads every file ending in .ini in the directory at path, sorted by name, using importConfigFile.
+func importConfigDir(dst map[string][]string, path string, dec *configReader) {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		dec.fail(exitFailure, "error reading directory <", path, ">: ", err)
+		return
+	}
+
+	for _, fi := range entries {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".ini" {
+			continue
+		}
+		importConfigFile(dst, filepath.Join(path, fi.Name()), dec)
+	}
+}
+
+func importConfigFile(dst map[string][]string, path string, dec *configReader) {
+	// Files being loaded are tracked by their absolute paths to catch include cycles
+	if isLocalPath(path) {
+		abs, err := filepath.Abs(path)
+		if err == nil {
+			for i, p := range dec.including {
+				if p == abs {
+					dec.fail(exitDataErr, "include cycle: ", strings.Join(append(dec.including[i:], abs), " -> "))
+					return
+				}
+			}
+			dec.including = append(dec.including, abs)
+			defer func() { dec.including = dec.including[:len(dec.including)-1] }()
+		}
+	}
+
+	b, err := dec.readInput(path)
+	if err != nil {
+		dec.fail(exitFailure, "error reading <", path, ">: ", err)
+		return
+	}
+	importConfig(dst, b, path, dec)
+}
+
+// isLocalPath returns whether path names a file, rather than standard input or a URL.
+func isLocalPath(path string) bool {
+	return path != "-" && !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://")
+}
+
+// importConfigVar loads the value of the environment variable name as an INI file. If name is unset or empty, nothing
+// is loaded and a warning is logged.
+func importConfigVar(dst map[string][]string, name string, dec *configReader) {
+	if b := os.Getenv(name); b != "" {
+		importConfig(dst, []byte(b), "$"+name, dec)
+	} else {
+		log("not loading INI from $", name, ": unset or empty")
+	}
+}
+
+// importConfig loads the INI file b, read from source, into dst.
+func importConfig(dst map[string][]string, b []byte, source string, dec *configReader) {
+	b, err := gunzip(b)
+	if err != nil {
+		dec.fail(exitDataErr, "error parsing INI ", source, ": ", err)
+		return
+	}
+
+	if dec.crlf {
+		b = foldCRLF(b)
+	}
+	if dec.stripComments {
+		b = stripINIComments(b)
+	}
+
+	// Conditions are evaluated against the values loaded before the file, or else the environment
+	lookup := func(name string) (string, bool) {
+		name = lookupKey(name)
+		if v := dst[name]; len(v) > 0 {
+			return v[len(v)-1], true
+		}
+		v, ok := dec.env[name]
+		return v, ok
+	}
+
+	newValues := func() fileValues {
+		return fileValues{
+			values:      map[string][]string{},
+			casing:      dec.casing,
+			replace:     dec.replace,
+			settingsSep: dec.Separator,
+			sections:    dec.sections,
+			lookup:      lookup,
+		}
+	}
+
+	// Values read before any error are still loaded
+	values := newValues()
+	err = dec.Read(bytes.NewReader(b), &values)
+
+	// If the file's [binit] section changes how keys are read, read it again
+	if len(values.settings) > 0 && dec.configure(values.settings, source) {
+		values = newValues()
+		err = dec.Read(bytes.NewReader(b), &values)
+	}
+	if err != nil {
+		dec.fail(exitDataErr, "error parsing INI ", source, ": ", err)
+	}
+
+	if dec.collapse {
+		for k, v := range values.values {
+			values.values[k] = []string{strings.Join(v, dec.seps.forKey(k))}
+		}
+	}
+
+	// Included files are loaded before the rest of the file, so that its own values take precedence over theirs.
+	// Relative paths are resolved against the directory of the including file.
+	for _, include := range values.includes {
+		if !filepath.IsAbs(include) && isLocalPath(source) {
+			include = filepath.Join(filepath.Dir(source), include)
+		}
+		debug(source, ": include <", include, ">")
+		for _, path := range globInput(include, dec) {
+			importConfigFile(dst, path, dec)
+		}
+	}
+	values.copyTo(dst, source)
+}
+
+// resolveCommand returns the path of the command name, searching PATH if name doesn't contain a slash. The PATH of
+// vars, as passed to the command, is searched if it's set. Otherwise, binit's own PATH is searched. If dir isn't empty,
+// a relative name containing a slash is resolved against dir, as it would be once the command runs in dir, and the
+// returned path is absolute.
+func resolveCommand(name, dir string, vars []envVar) (string, error) {
+	if dir != "" && strings.Contains(name, "/") && !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+
+	var path string
+	var err error
+	if pathList, ok := lookupVar(vars, "PATH"); ok && !strings.Contains(name, "/") {
+		path, err = lookPath(name, pathList)
+	} else {
+		path, err = exec.LookPath(name)
+	}
+	if err != nil || dir == "" {
+		return path, err
+	}
+	return filepath.Abs(path)
+}
+
+// lookupVar returns the value of the variable key in vars and whether it's set.
+func lookupVar(vars []envVar, key string) (string, bool) {
+	for _, v := range vars {
+		if v.key == key {
+			return v.value, true
+		}
+	}
+	return "", false
+}
+
+// lookPath searches the directories of pathList for an executable file named file, as exec.LookPath does for the PATH
+// of binit's own environment. Empty directories in pathList refer to the current directory.
+func lookPath(file, pathList string) (string, error) {
+	for _, dir := range filepath.SplitList(pathList) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, file)
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return path, nil
+		}
 	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
 }
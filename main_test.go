@@ -0,0 +1,481 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.spiff.io/go-ini"
+)
+
+func TestApplyListOpsSkipsLiteralValues(t *testing.T) {
+	defer func(ops, marks map[string]map[int]bool) { listOps, literals = ops, marks }(listOps, literals)
+	listOps, literals = map[string]map[int]bool{}, map[string]map[int]bool{}
+
+	values := map[string][]string{}
+	copyValues(values, escapeEnv(map[string]string{"A": "+:x", "B": "head:+", "PATH": "/bin"}), "environment")
+	addListValue(values, "PATH", "+:/opt/bin", "-e")
+
+	j := &joiner{seps: &Separators{sep: " "}}
+	applyListOps(values, j, &Separators{sep: ":"}, listOps, literals)
+
+	want := map[string][]string{
+		"A":    {"+:x"},
+		"B":    {"head:+"},
+		"PATH": {"/bin:/opt/bin"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("values = %q; want %q", values, want)
+	}
+}
+
+// newTestReader returns a configReader with binit's default settings: keys separated by ".", kept as written, and
+// multiple values joined by " ".
+func newTestReader() *configReader {
+	return &configReader{
+		Reader: ini.Reader{Separator: ".", Casing: ini.CaseSensitive, True: ini.True},
+		casing: keyCasing{sep: "."},
+		seps:   &Separators{sep: " "},
+	}
+}
+
+func TestImportConfigSectionsWithSettings(t *testing.T) {
+	dec := newTestReader()
+	dec.sections = []keyPattern{compilePattern("a", "section")}
+
+	values := map[string][]string{}
+	conf := "[binit]\nseparator = _\n\n[a]\ny = 1\n\n[b]\ny = 2\n"
+	importConfig(values, []byte(conf), "test.ini", dec)
+
+	want := map[string][]string{"a_y": {"1"}}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("values = %q; want %q", values, want)
+	}
+}
+
+func TestFileOptionsKeepSettings(t *testing.T) {
+	dec := newTestReader()
+
+	// A [binit] section in a file without options applies to later files
+	values := map[string][]string{}
+	restore := dec.withOptions(nil)
+	importConfig(values, []byte("[binit]\nseparator = _\n"), "first.ini", dec)
+	restore()
+	importConfig(values, []byte("[b]\ny = 1\n"), "second.ini", dec)
+
+	// Options only apply to their own file
+	restore = dec.withOptions(map[string]string{"casing": "upper", "separator": "-"})
+	importConfig(values, []byte("[c]\nz = 2\n"), "third.ini", dec)
+	restore()
+	importConfig(values, []byte("[d]\nw = 3\n"), "fourth.ini", dec)
+
+	want := map[string][]string{"b_y": {"1"}, "C-Z": {"2"}, "d_w": {"3"}}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("values = %q; want %q", values, want)
+	}
+}
+
+func TestHashVarsIgnoresKeyOrder(t *testing.T) {
+	defer func(order map[string]int) { keyOrder = order }(keyOrder)
+
+	hash := func(conf string) string {
+		keyOrder = map[string]int{}
+		dec := newTestReader()
+		values := map[string][]string{}
+		importConfig(values, []byte(conf), "test.ini", dec)
+		_, sum := hashVars(compileEnv(values, &joiner{seps: dec.seps}, "", nil, nil))
+		return sum
+	}
+
+	if a, b := hash("A = 1\nB = 2\n"), hash("B = 2\nA = 1\n"); a != b {
+		t.Fatalf("hashes differ by key order: %s != %s", a, b)
+	}
+}
+
+func TestExcludeKeysFoldedCase(t *testing.T) {
+	defer func(folded map[string]string) { foldedKeys = folded }(foldedKeys)
+	foldedKeys = map[string]string{}
+
+	values := map[string][]string{}
+	addValue(values, "Path", "/a", "environment")
+	excludeKeys(values, Strings{"PATH"})
+
+	if len(values) != 0 {
+		t.Fatalf("values = %q; want none", values)
+	}
+}
+
+func TestMissingRequiredFoldedCase(t *testing.T) {
+	defer func(folded map[string]string) { foldedKeys = folded }(foldedKeys)
+	foldedKeys = map[string]string{}
+
+	values := map[string][]string{}
+	addValue(values, "Path", "/a", "environment")
+	j := &joiner{seps: &Separators{sep: " "}}
+
+	if missing := missingRequired(values, []string{"PATH"}, j); len(missing) != 0 {
+		t.Fatalf("missing = %q; want none", missing)
+	}
+}
+
+func TestDotenvKeyCasing(t *testing.T) {
+	values := map[string][]string{}
+	p := dotenvParser{
+		s:      "export db.max-conns=10\n",
+		line:   1,
+		source: "test.env",
+		casing: keyCasing{modes: parseCasing("e"), sep: "."},
+	}
+	if err := p.parse(values); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{"DB_MAX_CONNS": {"10"}}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("values = %q; want %q", values, want)
+	}
+}
+
+func TestGlobInputLiteralPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"app[1].ini", "app1.ini"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "app[1].ini")
+	if got, want := globInput(path, &configReader{}), []string{path}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("globInput(%q) = %q; want %q", path, got, want)
+	}
+
+	pattern := filepath.Join(dir, "app[0-9].ini")
+	if got, want := globInput(pattern, &configReader{}), []string{filepath.Join(dir, "app1.ini")}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("globInput(%q) = %q; want %q", pattern, got, want)
+	}
+}
+
+func TestSystemdKeyCasing(t *testing.T) {
+	values := map[string][]string{}
+	p := systemdParser{source: "test.conf", line: 1, casing: keyCasing{modes: parseCasing("u"), sep: "."}}
+	p.parse(values, "foo=1\n")
+
+	want := map[string][]string{"FOO": {"1"}}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("values = %q; want %q", values, want)
+	}
+}
+
+func TestCopyAssignmentsPreserveOrder(t *testing.T) {
+	defer func(order map[string]int) { keyOrder = order }(keyOrder)
+	keyOrder = map[string]int{}
+
+	pairs := []string{"z=1", "a=2", "m=3", "a=4"}
+	values := map[string][]string{}
+	copyAssignments(values, parseEnv(pairs), pairKeys(pairs), nil)
+
+	if got, want := orderedKeys(values), []string{"z", "a", "m"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("orderedKeys() = %q; want %q", got, want)
+	}
+	if got, want := values["a"], []string{"4"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("a = %q; want %q", got, want)
+	}
+}
+
+func TestExpandArithmetic(t *testing.T) {
+	values := map[string][]string{
+		"cpus":    {"4"},
+		"workers": {"$((cpus * 2 + ${cpus}))"},
+		"escaped": {"$$((2*3))"},
+		"literal": {escapeValue("$((1+1))")},
+		"bad":     {"$((1/0))"},
+	}
+	expandValues(values, nil, &joiner{seps: &Separators{sep: " "}}, nil, true)
+
+	want := map[string][]string{
+		"cpus":    {"4"},
+		"workers": {"12"},
+		"escaped": {"$((2*3))"},
+		"literal": {"$((1+1))"},
+		"bad":     {"$((1/0))"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("values = %q; want %q", values, want)
+	}
+}
+
+func TestArithmeticOverflow(t *testing.T) {
+	for _, expr := range []string{
+		"9223372036854775807+1",
+		"-9223372036854775807-2",
+		"4611686018427387904*2",
+		"-(-9223372036854775807-1)",
+		"(-9223372036854775807-1)/-1",
+		"99999999999999999999",
+	} {
+		p := arithParser{s: expr}
+		if n, err := p.eval(); err != errOverflow {
+			t.Errorf("eval(%q) = %d, %v; want %v", expr, n, err, errOverflow)
+		}
+	}
+
+	p := arithParser{s: "-9223372036854775807-1"}
+	if n, err := p.eval(); err != nil || n != -9223372036854775807-1 {
+		t.Errorf("eval(%q) = %d, %v; want %d", p.s, n, err, int64(-9223372036854775807-1))
+	}
+}
+
+func TestRenderTemplatesSkipsLiteralValues(t *testing.T) {
+	defer func(marks map[string]map[int]bool) { literals = marks }(literals)
+	literals = map[string]map[int]bool{}
+
+	values := map[string][]string{}
+	copyValues(values, escapeEnv(map[string]string{"FOO": "{{.Env.HOME}}"}), "environment")
+	addValue(values, "BAR", "{{.Env.HOME}}/bar", "-e")
+
+	env := map[string]string{"HOME": "/home/binit"}
+	renderTemplates(values, env, &joiner{seps: &Separators{sep: " "}}, literals, true)
+
+	want := map[string][]string{
+		"FOO": {"{{.Env.HOME}}"},
+		"BAR": {"/home/binit/bar"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("values = %q; want %q", values, want)
+	}
+}
+
+func TestTOMLParser(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		want map[string][]string
+	}{
+		{"basic string", `a = "x\ty\u00e9\"z\\"`, map[string][]string{"a": {"x\tyé\"z\\"}}},
+		{"literal string", `a = 'C:\path\$x'`, map[string][]string{"a": {`C:\path\$x`}}},
+		{"multiline basic string", "a = \"\"\"\nline 1\nline \\\n    2\"\"\"", map[string][]string{"a": {"line 1\nline 2"}}},
+		{"multiline basic string quotes", `a = """say ""hi"""""`, map[string][]string{"a": {`say ""hi""`}}},
+		{"multiline literal string", "a = '''\nraw \\n\n'text'''' ", map[string][]string{"a": {"raw \\n\n'text'"}}},
+		{"dotted key", "a.b . c = 1", map[string][]string{"a.b.c": {"1"}}},
+		{"quoted key", `"a.b"."c d" = 1` + "\n'e' = 2", map[string][]string{"a.b.c d": {"1"}, "e": {"2"}}},
+		{"table", "top = 1\n[db]\nhost = 'x' # comment\n[db.pool]\nsize = 2", map[string][]string{
+			"top":          {"1"},
+			"db.host":      {"x"},
+			"db.pool.size": {"2"},
+		}},
+		{"array of tables", "[[srv]]\nname = 'a'\n[[srv]]\nname = 'b'\nport = 1", map[string][]string{
+			"srv.name": {"a", "b"},
+			"srv.port": {"1"},
+		}},
+		{"inline table", "db = { host = 'x', pool = { size = 2 } }", map[string][]string{
+			"db.host":      {"x"},
+			"db.pool.size": {"2"},
+		}},
+		{"array", "a = [\n  1, # one\n  'two',\n  [3],\n]", map[string][]string{"a": {"1", "two", "3"}}},
+		{"integers", "dec = +1_000\nhex = 0xff\noct = 0o17\nbin = 0b1\nneg = -5", map[string][]string{
+			"dec": {"1000"},
+			"hex": {"255"},
+			"oct": {"15"},
+			"bin": {"1"},
+			"neg": {"-5"},
+		}},
+		{"floats", "a = 1_000.5\nb = 6.626e-34\nc = -inf", map[string][]string{
+			"a": {"1000.5"},
+			"b": {"6.626e-34"},
+			"c": {"-inf"},
+		}},
+		{"dates", "a = 1979-05-27\nb = 1979-05-27 07:32:00Z\nc = 07:32:00", map[string][]string{
+			"a": {"1979-05-27"},
+			"b": {"1979-05-27 07:32:00Z"},
+			"c": {"07:32:00"},
+		}},
+		{"booleans", "a = true\nb = false", map[string][]string{"a": {"true"}, "b": {"false"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			values := map[string][]string{}
+			p := tomlParser{s: c.doc, dst: values, dec: newTestReader()}
+			if err := p.parse(); err != nil {
+				t.Fatalf("parse() = %v", err)
+			}
+			if !reflect.DeepEqual(values, c.want) {
+				t.Fatalf("values = %q; want %q", values, c.want)
+			}
+		})
+	}
+}
+
+func TestTOMLParserErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		line int
+	}{
+		{"missing value", "a =", 1},
+		{"missing equals", "a 1", 1},
+		{"missing key", "= 1", 1},
+		{"invalid value", "a = yes", 1},
+		{"invalid integer", "a = 0xfg", 1},
+		{"integer overflow", "a = 9_223_372_036_854_775_808", 1},
+		{"unterminated string", "a = 1\nb = \"x", 2},
+		{"newline in string", "a = \"x\ny\"", 1},
+		{"unterminated literal string", "a = 'x", 1},
+		{"unterminated multiline string", "a = '''x", 1},
+		{"invalid escape", `a = "\q"`, 1},
+		{"invalid unicode escape", `a = "\uZZZZ"`, 1},
+		{"unclosed table", "[a\nb = 1", 1},
+		{"unclosed array of tables", "[[a]\nb = 1", 1},
+		{"unclosed array", "a = [1 2]", 1},
+		{"unclosed inline table", "a = { b = 1 c = 2 }", 1},
+		{"trailing text", "a = 1 2", 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := tomlParser{s: c.doc, dst: map[string][]string{}, dec: newTestReader()}
+			err := p.parse()
+			if err == nil {
+				t.Fatal("parse() = nil; want error")
+			}
+			if line := p.line(); line != c.line {
+				t.Fatalf("parse() failed on line %d (%v); want line %d", line, err, c.line)
+			}
+		})
+	}
+}
+
+func TestExpandValues(t *testing.T) {
+	cases := []struct {
+		name  string
+		src   map[string][]string
+		env   map[string]string
+		allow []string // Patterns for -expand-only, if not nil
+		win   bool     // -winexpand
+		want  map[string][]string
+	}{
+		{
+			name: "braced and bare references",
+			src:  map[string][]string{"a": {"x"}, "b": {"${a}-$a-$a.y"}},
+			want: map[string][]string{"a": {"x"}, "b": {"x-x-x.y"}},
+		},
+		{
+			name: "section keys",
+			src:  map[string][]string{"db.host": {"h"}, "url": {"tcp://${db.host}"}},
+			want: map[string][]string{"db.host": {"h"}, "url": {"tcp://h"}},
+		},
+		{
+			name: "environment fallback",
+			src:  map[string][]string{"a": {"${HOME}/${MISSING}"}},
+			env:  map[string]string{"HOME": "/home/binit"},
+			want: map[string][]string{"a": {"/home/binit/"}},
+		},
+		{
+			name: "escapes",
+			src:  map[string][]string{"a": {"$$a $${a} $$$$ $ ${ $1"}},
+			want: map[string][]string{"a": {"$a ${a} $$ $ ${ $1"}},
+		},
+		{
+			name: "defaults",
+			src:  map[string][]string{"set": {"x"}, "empty": {""}, "a": {"${set:-d} ${empty:-d} ${unset:-d} ${unset:-}"}},
+			want: map[string][]string{"set": {"x"}, "empty": {""}, "a": {"x d d "}},
+		},
+		{
+			name: "nested defaults",
+			src:  map[string][]string{"b": {"y"}, "a": {"${x:-${y:-${b}}} ${x:-${b:+{$b}}}"}},
+			want: map[string][]string{"b": {"y"}, "a": {"y {y}"}},
+		},
+		{
+			name: "alternates",
+			src:  map[string][]string{"set": {"x"}, "empty": {""}, "a": {"[${set:+alt}][${empty:+alt}][${unset:+alt}]"}},
+			want: map[string][]string{"set": {"x"}, "empty": {""}, "a": {"[alt][][]"}},
+		},
+		{
+			name: "required and set",
+			src:  map[string][]string{"set": {"x"}, "a": {"${set:?missing}"}},
+			want: map[string][]string{"set": {"x"}, "a": {"x"}},
+		},
+		{
+			name: "earlier values",
+			src:  map[string][]string{"PATH": {"/bin", "${PATH}:/opt/bin"}},
+			want: map[string][]string{"PATH": {"/bin", "/bin:/opt/bin"}},
+		},
+		{
+			name: "cycle",
+			src:  map[string][]string{"c": {"[$c]"}, "d": {"${c:-x}"}},
+			want: map[string][]string{"c": {"[]"}, "d": {"[]"}},
+		},
+		{
+			name:  "expand only",
+			src:   map[string][]string{"a": {"x"}, "b": {"y"}, "c": {"$a ${b} ${b:-d} $$a"}},
+			allow: []string{"a"},
+			want:  map[string][]string{"a": {"x"}, "b": {"y"}, "c": {"x ${b} ${b:-d} $a"}},
+		},
+		{
+			name: "percent references ignored",
+			src:  map[string][]string{"a": {"x"}, "b": {"%a% %%"}},
+			want: map[string][]string{"a": {"x"}, "b": {"%a% %%"}},
+		},
+		{
+			name: "percent references",
+			src:  map[string][]string{"a": {"x"}, "b": {"%a% %%a%% 100% %a.b% %"}},
+			win:  true,
+			want: map[string][]string{"a": {"x"}, "b": {"x %a% 100%  %"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer func(win bool) { winExpand = win }(winExpand)
+			winExpand = c.win
+
+			var allow []keyPattern
+			if c.allow != nil {
+				allow = []keyPattern{}
+				for _, name := range c.allow {
+					allow = append(allow, compilePattern(name, "expansion"))
+				}
+			}
+			expandValues(c.src, c.env, &joiner{seps: &Separators{sep: " "}}, allow, false)
+			if !reflect.DeepEqual(c.src, c.want) {
+				t.Fatalf("values = %q; want %q", c.src, c.want)
+			}
+		})
+	}
+}
+
+func TestExpandMutualCycle(t *testing.T) {
+	values := map[string][]string{"a": {"<${b}>"}, "b": {"(${a})"}}
+	expandValues(values, nil, &joiner{seps: &Separators{sep: " "}}, nil, false)
+
+	// The cycle is broken at whichever key is expanded first, so its reference to the other expands to nothing
+	aFirst := map[string][]string{"a": {"<()>"}, "b": {"()"}}
+	bFirst := map[string][]string{"a": {"<>"}, "b": {"(<>)"}}
+	if !reflect.DeepEqual(values, aFirst) && !reflect.DeepEqual(values, bFirst) {
+		t.Fatalf("values = %q; want %q or %q", values, aFirst, bFirst)
+	}
+}
+
+func TestExpandRequiredUnset(t *testing.T) {
+	if os.Getenv("BINIT_TEST_EXPAND_REQUIRED") == "1" {
+		values := map[string][]string{"a": {"${unset:?must be set}"}}
+		expandValues(values, nil, &joiner{seps: &Separators{sep: " "}}, nil, false)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExpandRequiredUnset$")
+	cmd.Env = append(os.Environ(), "BINIT_TEST_EXPAND_REQUIRED=1")
+	out, err := cmd.CombinedOutput()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != exitUsage {
+		t.Fatalf("exit = %v; want status %d\n%s", err, exitUsage, out)
+	}
+	if want := "unset (referenced by a): must be set"; !strings.Contains(string(out), want) {
+		t.Fatalf("output = %q; want %q", out, want)
+	}
+}
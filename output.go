@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outputFormat is the format used to print the environment when binit is given no command.
+type outputFormat string
+
+const (
+	envFormat        outputFormat = "env"
+	jsonFormat       outputFormat = "json"
+	exportFormat     outputFormat = "export"
+	unsetFormat      outputFormat = "unset"
+	fishFormat       outputFormat = "fish"
+	powershellFormat outputFormat = "powershell"
+	iniFormat        outputFormat = "ini"
+	dockerFormat     outputFormat = "docker-envfile"
+)
+
+func (f *outputFormat) String() string {
+	return string(*f)
+}
+
+func (f *outputFormat) Set(str string) error {
+	switch next := outputFormat(str); next {
+	case envFormat, jsonFormat, exportFormat, unsetFormat, fishFormat, powershellFormat, iniFormat, dockerFormat:
+		*f = next
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q", str)
+}
+
+// masks are the patterns of keys whose values are masked when printed or logged (-mask).
+var masks []keyPattern
+
+// maskFlag is a flag.Value that adds a pattern to masks.
+type maskFlag struct{}
+
+func (maskFlag) String() string {
+	return "[]"
+}
+
+func (maskFlag) Set(str string) error {
+	masks = append(masks, compilePattern(str, "mask"))
+	return nil
+}
+
+// maskedValue is printed in place of masked values.
+const maskedValue = "****"
+
+// isMasked returns whether the values of key are masked.
+func isMasked(key string) bool {
+	for _, pat := range masks {
+		if pat.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskValue returns value, or maskedValue if the values of key are masked.
+func maskValue(key, value string) string {
+	if isMasked(key) {
+		return maskedValue
+	}
+	return value
+}
+
+// maskVars returns a copy of vars with masked values replaced by maskedValue.
+func maskVars(vars []envVar) []envVar {
+	masked := make([]envVar, len(vars))
+	for i, v := range vars {
+		if v.masked {
+			v.value = maskedValue
+			v.values = make([]string, len(v.values))
+			for j := range v.values {
+				v.values[j] = maskedValue
+			}
+		}
+		masked[i] = v
+	}
+	return masked
+}
+
+// grepVars returns the vars whose keys match any of patterns.
+func grepVars(vars []envVar, patterns []string) []envVar {
+	pats := make([]keyPattern, len(patterns))
+	for i, p := range patterns {
+		pats[i] = compilePattern(p, "grep")
+	}
+
+	var matched []envVar
+	for _, v := range vars {
+		for _, pat := range pats {
+			if pat.match(v.key) {
+				matched = append(matched, v)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// onlyVars returns the vars whose keys begin with any of prefixes, with the first such prefix removed from their keys.
+// Variables whose keys are only a prefix are dropped.
+func onlyVars(vars []envVar, prefixes []string) []envVar {
+	var matched []envVar
+	for _, v := range vars {
+		for _, prefix := range prefixes {
+			if len(v.key) > len(prefix) && strings.HasPrefix(v.key, prefix) {
+				v.key = v.key[len(prefix):]
+				matched = append(matched, v)
+				break
+			}
+		}
+	}
+	sortVars(matched)
+	return matched
+}
+
+// writeFormat writes vars to w in the given format. term terminates each pair written in the env format, and sep
+// splits keys into sections in the ini format. Values are quoted with quote in the env, export, fish, and powershell
+// formats. If quote is noQuote, values are quoted as each format requires, and aren't quoted in the env format.
+func writeFormat(w io.Writer, format outputFormat, vars []envVar, term, sep string, quote quoteStyle) error {
+	switch format {
+	case jsonFormat:
+		return writeJSON(w, vars)
+	case exportFormat:
+		return writeExport(w, vars, quote.or(shQuote))
+	case unsetFormat:
+		return writeUnset(w, vars)
+	case fishFormat:
+		return writeFish(w, vars, quote.or(fishQuote))
+	case powershellFormat:
+		return writePowerShell(w, vars, quote.or(powershellQuote))
+	case iniFormat:
+		return writeINI(w, vars, sep)
+	case dockerFormat:
+		return writeDockerEnvFile(w, vars)
+	default:
+		return writeEnv(w, vars, term, quote)
+	}
+}
+
+// writeFileAtomic calls write with a temporary file in the same directory as path, then renames the temporary file
+// to path, so that a concurrent reader of path sees either its old or new contents, and never a partial file. If path
+// already exists, its permissions are kept. Otherwise, it's created readable and writable only by its owner.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// diffMode is a flag.Value for how -diff prints changed variables. Given without a value, only their new values are
+// printed.
+type diffMode string
+
+const (
+	noDiff      diffMode = ""
+	shortDiff   diffMode = "short"
+	verboseDiff diffMode = "verbose"
+)
+
+func (m *diffMode) String() string {
+	return string(*m)
+}
+
+func (m *diffMode) Set(str string) error {
+	switch next := diffMode(str); next {
+	case "true", shortDiff:
+		*m = shortDiff
+	case "false":
+		*m = noDiff
+	case verboseDiff:
+		*m = next
+	default:
+		return fmt.Errorf("unknown diff mode %q", str)
+	}
+	return nil
+}
+
+func (m *diffMode) IsBoolFlag() bool {
+	return true
+}
+
+// writeDiff writes the variables of vars whose values differ from those of env to w. New variables are written as
+// +KEY=value and changed variables as ~KEY=value. Under verboseDiff, changed variables are written as
+// ~KEY: "old" -> "new" instead. Both the old and new values of masked variables are masked.
+func writeDiff(w io.Writer, vars []envVar, env map[string]string, mode diffMode) error {
+	var b strings.Builder
+	for _, v := range vars {
+		old, ok := env[v.key]
+		if ok && old == v.value {
+			continue
+		}
+
+		value := v.value
+		if v.masked {
+			old, value = maskedValue, maskedValue
+		}
+		switch {
+		case !ok:
+			b.WriteString("+" + v.key + "=" + value + "\n")
+		case mode == verboseDiff:
+			b.WriteString("~" + v.key + ": " + strconv.Quote(old) + " -> " + strconv.Quote(value) + "\n")
+		default:
+			b.WriteString("~" + v.key + "=" + value + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeEnv writes each KEY=value pair of vars to w, followed by term, with the value quoted by quote.
+func writeEnv(w io.Writer, vars []envVar, term string, quote quoteStyle) error {
+	for _, v := range vars {
+		if _, err := io.WriteString(w, v.key+"="+quote.quote(v.value)+term); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNames writes the key of each variable in vars to w, sorted unless keys are kept in the order they were set
+// (-preserve-order), each followed by term.
+func writeNames(w io.Writer, vars []envVar, term string) error {
+	names := make([]string, len(vars))
+	for i, v := range vars {
+		names[i] = v.key
+	}
+	if keyOrder == nil {
+		sort.Strings(names)
+	}
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + term)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeJSON writes vars to w as a single JSON object. Keys with more than one value are written as arrays of strings;
+// all other keys are written as strings. Keys are sorted unless they're kept in the order they were set
+// (-preserve-order), in which case they're written in the order of vars.
+func writeJSON(w io.Writer, vars []envVar) error {
+	if keyOrder != nil {
+		return writeOrderedJSON(w, vars)
+	}
+
+	obj := make(map[string]interface{}, len(vars))
+	for _, v := range vars {
+		obj[v.key] = jsonValue(v)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(obj)
+}
+
+// writeOrderedJSON writes vars to w as writeJSON does, but in the order of vars, since maps are encoded sorted.
+func writeOrderedJSON(w io.Writer, vars []envVar) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("  ", "  ")
+
+	b.WriteString("{")
+	for i, v := range vars {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n  ")
+		if err := enc.Encode(v.key); err != nil {
+			return err
+		}
+		b.Truncate(b.Len() - 1) // Encode terminates each value with a newline
+		b.WriteString(": ")
+		if err := enc.Encode(jsonValue(v)); err != nil {
+			return err
+		}
+		b.Truncate(b.Len() - 1)
+	}
+	if len(vars) > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// jsonValue returns the value of v as written to JSON: a string if v has a single value, or else an array of strings.
+func jsonValue(v envVar) interface{} {
+	if len(v.values) == 1 {
+		return v.values[0]
+	}
+	return v.values
+}
+
+// writeExport writes each variable in vars to w as a POSIX shell export statement, with the value quoted by quote.
+func writeExport(w io.Writer, vars []envVar, quote quoteStyle) error {
+	for _, v := range vars {
+		if _, err := io.WriteString(w, "export "+v.key+"="+quote.quote(v.value)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFish writes each variable in vars to w as a fish shell set statement, exporting the variable globally, with the
+// value quoted by quote.
+func writeFish(w io.Writer, vars []envVar, quote quoteStyle) error {
+	for _, v := range vars {
+		if _, err := io.WriteString(w, "set -gx "+v.key+" "+quote.quote(v.value)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePowerShell writes each variable in vars to w as a PowerShell assignment to $env:KEY, with the value quoted by
+// quote. Keys that PowerShell can't parse bare are braced, as ${env:KEY}.
+func writePowerShell(w io.Writer, vars []envVar, quote quoteStyle) error {
+	for _, v := range vars {
+		name := "$env:" + v.key
+		if !isPOSIXName(v.key) {
+			name = "${env:" + strings.NewReplacer("`", "``", "}", "`}").Replace(v.key) + "}"
+		}
+		if _, err := io.WriteString(w, name+" = "+quote.quote(v.value)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeUnset writes an unset statement to w for each variable in vars.
+func writeUnset(w io.Writer, vars []envVar) error {
+	for _, v := range vars {
+		if _, err := io.WriteString(w, "unset "+v.key+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDockerEnvFile writes each KEY=value pair of vars to w, one per line, as read by docker run --env-file. Docker
+// takes the rest of each line as the value, without unquoting it, so values are written as-is. Since a pair can't span
+// lines, nothing is written if any value contains a newline or carriage return, or any name is one docker would read
+// differently: empty, containing whitespace, or beginning with #.
+func writeDockerEnvFile(w io.Writer, vars []envVar) error {
+	for _, v := range vars {
+		switch {
+		case v.key == "" || strings.HasPrefix(v.key, "#") || strings.ContainsAny(v.key, " \t\n\r\v\f"):
+			return fmt.Errorf("variable name %q can't be written to a docker env file", v.key)
+		case strings.ContainsAny(v.value, "\n\r"):
+			return fmt.Errorf("value of %s contains a line break, which a docker env file can't hold", v.key)
+		}
+	}
+
+	var b strings.Builder
+	for _, v := range vars {
+		b.WriteString(v.pair() + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeINI writes vars to w as an INI file. Each key is split at its last occurrence of sep into a section and a name,
+// and keys are grouped into their sections. Sections are sorted unless keys are kept in the order they were set
+// (-preserve-order), in which case they're written in the order they first appear in vars. Keys with more than one value
+// are written once per value. Values are escaped so that loading the file with binit reproduces them.
+func writeINI(w io.Writer, vars []envVar, sep string) error {
+	type iniKey struct {
+		section, name string
+		values        []string
+	}
+	keys := make([]iniKey, len(vars))
+	sections := map[string]int{"": -1} // Keys without a section must come first
+	for i, v := range vars {
+		keys[i] = iniKey{name: v.key, values: v.values}
+		if sep != "" {
+			if n := strings.LastIndex(v.key, sep); n != -1 {
+				keys[i].section, keys[i].name = v.key[:n], v.key[n+len(sep):]
+			}
+		}
+		if _, ok := sections[keys[i].section]; !ok {
+			sections[keys[i].section] = len(sections)
+		}
+	}
+	sort.SliceStable(keys, func(a, b int) bool {
+		if keyOrder != nil {
+			return sections[keys[a].section] < sections[keys[b].section]
+		}
+		return keys[a].section < keys[b].section
+	})
+
+	var b strings.Builder
+	section := ""
+	for _, k := range keys {
+		if k.section != section {
+			if b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString("[" + k.section + "]\n")
+			section = k.section
+		}
+		for _, v := range k.values {
+			b.WriteString(k.name + " = " + iniQuote(strings.Replace(v, "$", "$$", -1)) + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// iniQuote quotes s as an INI value if it can't be written bare. Values are raw-quoted with backticks where possible,
+// and double-quoted with Go escapes otherwise.
+func iniQuote(s string) string {
+	if s != "" && strings.TrimSpace(s) == s && !strings.ContainsAny(s, "\"`#;\n\r\\") {
+		return s
+	}
+	if !strings.Contains(s, "`") && !strings.Contains(s, "\r") {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
+
+// writePlan writes the path, working directory (if not empty), arguments, and environment of a command to w as
+// a human-readable exec plan. Arguments and KEY=value pairs are quoted so that each is written on a single line.
+func writePlan(w io.Writer, path, dir string, argv []string, vars []envVar) error {
+	var b strings.Builder
+	b.WriteString("path: " + path + "\n")
+	if dir != "" {
+		b.WriteString("dir: " + dir + "\n")
+	}
+	b.WriteString("argv:")
+	for _, arg := range argv {
+		b.WriteString(" " + strconv.Quote(arg))
+	}
+	b.WriteString("\nenv:\n")
+	for _, v := range vars {
+		b.WriteString("  " + strconv.Quote(v.pair()) + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
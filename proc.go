@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// importProcessEnv loads the environment of the process with the given pid from /proc/PID/environ into dst. As with
+// binit's own environment, values are escaped so that they're never expanded. Only Linux is supported, and reading the
+// environment of another user's process requires the same permissions as ptrace(2).
+func importProcessEnv(dst map[string][]string, pid string, dec *configReader) {
+	if n, err := strconv.Atoi(pid); err != nil || n <= 0 {
+		fatal(exitUsage, "invalid process ID for -from-pid: ", strconv.Quote(pid))
+	}
+
+	if runtime.GOOS != "linux" {
+		dec.fail(exitFailure, "cannot read environment of process ", pid, ": -from-pid is only supported on Linux")
+		return
+	}
+
+	path := "/proc/" + pid + "/environ"
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		dec.fail(exitFailure, "cannot read environment of process ", pid, ": no such process")
+		return
+	case os.IsPermission(err):
+		dec.fail(exitFailure, "cannot read environment of process ", pid, ": permission denied (the process may belong to another user)")
+		return
+	case err != nil:
+		dec.fail(exitFailure, "error reading <", path, ">: ", err)
+		return
+	}
+
+	// environ is NUL-terminated, and is empty for zombies and kernel threads
+	var environ []string
+	for _, pair := range bytes.Split(bytes.TrimSuffix(b, []byte{0}), []byte{0}) {
+		if len(pair) > 0 {
+			environ = append(environ, string(pair))
+		}
+	}
+	copyValues(dst, escapeEnv(parseEnv(environ)), "process "+pid)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// quoteStyle is a flag.Value for the shell that printed values are quoted for (-quote).
+type quoteStyle string
+
+const (
+	noQuote         quoteStyle = ""
+	shQuote         quoteStyle = "sh"
+	bashQuote       quoteStyle = "bash"
+	fishQuote       quoteStyle = "fish"
+	powershellQuote quoteStyle = "powershell"
+)
+
+func (q *quoteStyle) String() string {
+	return string(*q)
+}
+
+func (q *quoteStyle) Set(str string) error {
+	switch next := quoteStyle(str); next {
+	case shQuote, bashQuote, fishQuote, powershellQuote:
+		*q = next
+		return nil
+	case "none":
+		*q = noQuote
+		return nil
+	}
+	return fmt.Errorf("unknown quoting %q", str)
+}
+
+// or returns q, or def if q is noQuote.
+func (q quoteStyle) or(def quoteStyle) quoteStyle {
+	if q == noQuote {
+		return def
+	}
+	return q
+}
+
+// quote quotes s so that the shell of q reads it as a single word with the value s. Newlines are kept as-is inside
+// quotes for each shell but bash, which quotes values containing control characters with $'...' so that they're
+// written on a single line.
+func (q quoteStyle) quote(s string) string {
+	switch q {
+	case shQuote:
+		return shellQuote(s)
+	case bashQuote:
+		return bashQuoteString(s)
+	case fishQuote:
+		// Within single quotes, fish only treats backslashes and single quotes specially
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+	case powershellQuote:
+		// Within single quotes, PowerShell only treats single quotes specially, including typographic ones
+		return "'" + strings.NewReplacer(`'`, `''`, "‘", "‘‘", "’", "’’",
+			"‚", "‚‚", "‛", "‛‛").Replace(s) + "'"
+	}
+	return s
+}
+
+// shellQuote single-quotes s for a POSIX shell. Single quotes in s are closed, escaped, and reopened.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellWord returns s as-is if a POSIX shell would read it as a single word with the value s, or else quoted by
+// shellQuote.
+func shellWord(s string) string {
+	if s == "" {
+		return shellQuote(s)
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !isNameByte(c) && strings.IndexByte("@%+=:,./-", c) == -1 {
+			return shellQuote(s)
+		}
+	}
+	return s
+}
+
+// bashQuoteString quotes s for bash. Values without control characters are single-quoted as for a POSIX shell. Others
+// are ANSI-C quoted, as $'...', with control characters escaped.
+func bashQuoteString(s string) string {
+	if strings.IndexFunc(s, isControl) == -1 {
+		return shellQuote(s)
+	}
+
+	var b strings.Builder
+	b.WriteString("$'")
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '\'':
+			b.WriteString(`\` + string(c))
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if isControl(rune(c)) {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteString("'")
+	return b.String()
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// parseSignal parses a signal name, with or without a SIG prefix, or number.
+func parseSignal(name string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
+
+// Signals is a flag.Value for a comma-separated list of signals. A nil Signals means no list was given.
+type Signals []os.Signal
+
+func (s *Signals) String() string {
+	return ""
+}
+
+func (s *Signals) Set(str string) error {
+	if *s == nil {
+		*s = Signals{}
+	}
+	for _, name := range strings.Split(str, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		sig, err := parseSignal(name)
+		if err != nil {
+			return err
+		}
+		*s = append(*s, sig)
+	}
+	return nil
+}
+
+// FDs is a flag.Value for a comma-separated list of file descriptors. A nil FDs means no list was given.
+type FDs []int
+
+func (f *FDs) String() string {
+	return ""
+}
+
+func (f *FDs) Set(str string) error {
+	if *f == nil {
+		*f = FDs{}
+	}
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		fd, err := strconv.Atoi(s)
+		if err != nil || fd < 0 {
+			return fmt.Errorf("invalid file descriptor %q", s)
+		}
+		*f = append(*f, fd)
+	}
+	return nil
+}
+
+// runOptions configures how run supervises a command.
+type runOptions struct {
+	// forward is the list of signals relayed to the command's process group.
+	forward []os.Signal
+	// reap controls whether binit reaps any child process that exits, not just the command, as an init process must.
+	reap bool
+	// dir is the working directory of the command. If empty, the command uses binit's working directory.
+	dir string
+	// cred, if not nil, is the user and groups to run the command as.
+	cred *credential
+	// timeout, if positive, is how long the command may run before its process group is sent SIGTERM. If it's still
+	// running after grace, it's sent SIGKILL.
+	timeout time.Duration
+	grace   time.Duration
+	// setsid controls whether the command is started in a new session, detached from any controlling terminal, instead
+	// of a new process group in binit's session.
+	setsid bool
+	// stdout and stderr, if not nil, are written the command's standard output and error in place of binit's (-tee).
+	stdout io.Writer
+	stderr io.Writer
+}
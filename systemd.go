@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+)
+
+// importSystemdFile loads a systemd EnvironmentFile from the file at path into dst, following the parsing rules of
+// systemd.exec(5). Lines beginning with # or ; are comments, and lines without an = are ignored. Values may be
+// single-quoted (literal), double-quoted (where \ escapes ", \, `, $, and a newline), or unquoted (where \ escapes any
+// character). A \ at the end of a line continues the value onto the next line, and quoted values may span lines.
+//
+// systemd doesn't expand variables in environment files, so $ is always taken literally. Keys are cased as by -c.
+func importSystemdFile(dst map[string][]string, path string, dec *configReader) {
+	b, err := dec.readInput(path)
+	if err != nil {
+		dec.fail(exitFailure, "error reading <", path, ">: ", err)
+		return
+	}
+
+	p := systemdParser{source: path, line: 1, casing: dec.casing}
+	p.parse(dst, string(b))
+}
+
+type systemdState int
+
+const (
+	sdPreKey systemdState = iota
+	sdKey
+	sdPreValue
+	sdValue
+	sdValueEscape
+	sdSingleQuote
+	sdDoubleQuote
+	sdDoubleQuoteEscape
+	sdComment
+	sdCommentEscape
+)
+
+type systemdParser struct {
+	source string
+	line   int
+	casing keyCasing
+
+	key   strings.Builder
+	value strings.Builder
+	// keep is the length of value less any trailing unquoted, unescaped whitespace, which is trimmed.
+	keep int
+}
+
+func (p *systemdParser) parse(dst map[string][]string, s string) {
+	state := sdPreKey
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch state {
+		case sdPreKey:
+			if c == '#' || c == ';' {
+				state = sdComment
+			} else if !isSystemdSpace(c) {
+				state = sdKey
+				p.key.WriteByte(c)
+			}
+		case sdKey:
+			if c == '\n' {
+				// Lines without an = are ignored
+				p.key.Reset()
+				state = sdPreKey
+			} else if c == '=' {
+				state = sdPreValue
+			} else {
+				p.key.WriteByte(c)
+			}
+		case sdPreValue, sdValue:
+			switch {
+			case c == '\n':
+				p.emit(dst)
+				state = sdPreKey
+			case c == '\'' && state == sdPreValue:
+				state = sdSingleQuote
+			case c == '"' && state == sdPreValue:
+				state = sdDoubleQuote
+			case c == '\\':
+				state = sdValueEscape
+			case isSystemdSpace(c):
+				if state == sdValue {
+					p.value.WriteByte(c)
+				}
+			default:
+				state = sdValue
+				p.write(c)
+			}
+		case sdValueEscape:
+			state = sdValue
+			if c != '\n' {
+				p.write(c)
+			}
+		case sdSingleQuote:
+			if c == '\'' {
+				state = sdPreValue
+			} else {
+				p.write(c)
+			}
+		case sdDoubleQuote:
+			if c == '"' {
+				state = sdPreValue
+			} else if c == '\\' {
+				state = sdDoubleQuoteEscape
+			} else {
+				p.write(c)
+			}
+		case sdDoubleQuoteEscape:
+			state = sdDoubleQuote
+			if strings.IndexByte("\"\\`$", c) != -1 {
+				p.write(c)
+			} else if c != '\n' {
+				p.write('\\')
+				p.write(c)
+			}
+		case sdComment:
+			if c == '\\' {
+				state = sdCommentEscape
+			} else if c == '\n' {
+				state = sdPreKey
+			}
+		case sdCommentEscape:
+			state = sdComment
+		}
+
+		if c == '\n' {
+			p.line++
+		}
+	}
+
+	switch state {
+	case sdPreValue, sdValue, sdValueEscape, sdSingleQuote, sdDoubleQuote, sdDoubleQuoteEscape:
+		p.emit(dst)
+	}
+}
+
+// write appends c to the value, keeping it from being trimmed.
+func (p *systemdParser) write(c byte) {
+	p.value.WriteByte(c)
+	p.keep = p.value.Len()
+}
+
+func (p *systemdParser) emit(dst map[string][]string) {
+	key := strings.TrimRight(p.key.String(), " \t\r")
+	value := p.value.String()[:p.keep]
+	p.key.Reset()
+	p.value.Reset()
+	p.keep = 0
+
+	if !isPOSIXName(key) {
+		log("ignoring invalid variable name in ", p.source, ": line ", p.line, ": ", key)
+		return
+	}
+	addLiteralValue(dst, p.casing.apply(key), escapeValue(value), p.source)
+}
+
+func isSystemdSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
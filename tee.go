@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// teeFile is an io.Writer that appends to a file, for copying a command's output under -tee. If a write to the file
+// fails, such as when its disk is full, the error is logged and later writes are discarded, so that the output is still
+// passed through to binit's own. Writes are serialized so that the command's standard output and error can share it.
+type teeFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File // nil once a write fails.
+}
+
+func (t *teeFile) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return len(p), nil
+	}
+	if _, err := t.f.Write(p); err != nil {
+		log("error writing to <", t.path, ">; no longer copying output to it: ", err)
+		t.f.Close()
+		t.f = nil
+	}
+	return len(p), nil
+}
+
+// teeOutputs returns the writers that a command's standard output and error are copied to, along with binit's own,
+// under -tee, -tee-out, and -tee-err. Output is copied to the file at out or err, if given, or else both, if given.
+// Files are opened for appending, created if they don't exist. A writer is nil if its output isn't copied to a file,
+// including if its file can't be opened: the error is logged, or is fatal if strict is set.
+func teeOutputs(both, out, err string, strict bool) (stdout, stderr io.Writer) {
+	if out == "" {
+		out = both
+	}
+	if err == "" {
+		err = both
+	}
+
+	files := map[string]*teeFile{}
+	open := func(path string) *teeFile {
+		if path == "" {
+			return nil
+		} else if t, ok := files[path]; ok {
+			return t
+		}
+
+		f, ferr := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if ferr != nil && strict {
+			fatal(exitFailure, "error opening <", path, "> to copy output to: ", ferr)
+		} else if ferr != nil {
+			log("error opening <", path, "> to copy output to; not copying it: ", ferr)
+		}
+		var t *teeFile
+		if ferr == nil {
+			t = &teeFile{path: path, f: f}
+		}
+		files[path] = t
+		return t
+	}
+
+	if t := open(out); t != nil {
+		stdout = io.MultiWriter(os.Stdout, t)
+	}
+	if t := open(err); t != nil {
+		stderr = io.MultiWriter(os.Stderr, t)
+	}
+	return stdout, stderr
+}
+
+// pipeTo returns the write end of a pipe whose contents are copied to w, and a channel that's closed once the read
+// end reaches EOF: when every copy of the write end, including the command's, is closed.
+func pipeTo(w io.Writer) (*os.File, <-chan struct{}, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer r.Close()
+		_, _ = io.Copy(w, r)
+	}()
+	return pw, done, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+)
+
+// templateData is the data that value templates are executed with.
+type templateData struct {
+	// Env is the current environment, as inherited by binit.
+	Env map[string]string
+	// Values is the merged environment, with each key's values joined.
+	Values map[string]string
+}
+
+// renderTemplates executes each value of src containing {{ as a text/template, replacing it with the result. Values are
+// rendered against the merged values of src as they were before any were rendered. Values marked in literal, by their
+// keys and indices, aren't rendered. If a value fails to render, it's left as-is and the error is logged, or is fatal
+// if strict is set.
+func renderTemplates(src map[string][]string, env map[string]string, j *joiner, literal map[string]map[int]bool, strict bool) {
+	data := templateData{
+		Env:    env,
+		Values: make(map[string]string, len(src)),
+	}
+	for k, v := range src {
+		data.Values[k] = j.join(k, v)
+	}
+
+	for k, v := range src {
+		for i, s := range v {
+			if literal[k][i] || !strings.Contains(s, "{{") {
+				continue
+			}
+
+			var b strings.Builder
+			t, err := template.New(k).Option("missingkey=error").Parse(s)
+			if err == nil {
+				err = t.Execute(&b, data)
+			}
+			if err != nil && strict {
+				fatal(exitDataErr, "error rendering template in ", k, ": ", err)
+			} else if err != nil {
+				log("error rendering template in ", k, ": ", err)
+				continue
+			}
+			v[i] = b.String()
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// importTOMLFile loads a TOML document from the file at path into dst. Tables are flattened, joining their keys to
+// their parents' using the separator of dec, and arrays are loaded as multiple values for their key. Arrays of tables
+// add their keys' values in order, as if each table were a repeated section of an INI file. Integers are loaded in
+// decimal, however they're written, and floats less any underscores. Booleans and dates are loaded as written. Keys are
+// cased according to dec.
+//
+// The parser is lenient: it doesn't reject redefined keys or tables, or arrays of mixed types.
+func importTOMLFile(dst map[string][]string, path string, dec *configReader) {
+	b, err := dec.readInput(path)
+	if err != nil {
+		dec.fail(exitFailure, "error reading <", path, ">: ", err)
+		return
+	}
+
+	values := map[string][]string{}
+	p := tomlParser{s: string(b), dst: values, dec: dec}
+	if err = p.parse(); err != nil {
+		dec.fail(exitDataErr, "error parsing TOML ", path, ": line ", p.line(), ": ", err)
+		return
+	}
+	for _, k := range p.keys {
+		for _, v := range values[k] {
+			addValue(dst, k, v, path)
+		}
+	}
+}
+
+type tomlParser struct {
+	s    string
+	pos  int
+	dst  map[string][]string
+	keys []string // The keys of dst, in the order they first appear.
+	dec  *configReader
+}
+
+func (p *tomlParser) line() int {
+	return strings.Count(p.s[:p.pos], "\n") + 1
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *tomlParser) rest() string {
+	return p.s[p.pos:]
+}
+
+func (p *tomlParser) add(key, value string) {
+	key = p.dec.casing.apply(key)
+	if _, ok := p.dst[key]; !ok {
+		p.keys = append(p.keys, key)
+	}
+	p.dst[key] = append(p.dst[key], value)
+}
+
+func (p *tomlParser) join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + p.dec.Separator + key
+}
+
+// skipSpace skips spaces and tabs.
+func (p *tomlParser) skipSpace() {
+	for !p.eof() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// skipBlank skips whitespace, newlines, and comments.
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if i := strings.IndexByte(p.rest(), '\n'); i != -1 {
+		p.pos += i
+	} else {
+		p.pos = len(p.s)
+	}
+}
+
+// endLine consumes trailing whitespace and an optional comment up to and including the end of the current line.
+func (p *tomlParser) endLine() error {
+	p.skipSpace()
+	if p.peek() == '#' {
+		p.skipComment()
+	}
+	if strings.HasPrefix(p.rest(), "\r\n") {
+		p.pos += 2
+	} else if p.peek() == '\n' {
+		p.pos++
+	} else if !p.eof() {
+		return fmt.Errorf("unexpected %q at end of line", p.peek())
+	}
+	return nil
+}
+
+func (p *tomlParser) parse() error {
+	table := ""
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+
+		if p.peek() == '[' {
+			// Arrays of tables are treated the same as tables, so that their keys accumulate values.
+			closing := "]"
+			p.pos++
+			if p.peek() == '[' {
+				closing = "]]"
+				p.pos++
+			}
+
+			p.skipSpace()
+			key, err := p.key()
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(p.rest(), closing) {
+				return fmt.Errorf("expected %q after table name", closing)
+			}
+			p.pos += len(closing)
+			table = key
+		} else {
+			key, err := p.key()
+			if err != nil {
+				return err
+			}
+			if p.peek() != '=' {
+				return errors.New("expected = after key")
+			}
+			p.pos++
+			p.skipSpace()
+			if err = p.value(p.join(table, key)); err != nil {
+				return err
+			}
+		}
+
+		if err := p.endLine(); err != nil {
+			return err
+		}
+	}
+}
+
+// key parses a dotted key, returning its parts joined by the key separator. Trailing whitespace is consumed.
+func (p *tomlParser) key() (string, error) {
+	var key string
+	for {
+		var part string
+		var err error
+		switch c := p.peek(); {
+		case c == '"':
+			part, err = p.basicString()
+		case c == '\'':
+			part, err = p.literalString()
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyByte(p.s[p.pos]) {
+				p.pos++
+			}
+			if start == p.pos {
+				return "", errors.New("expected key")
+			}
+			part = p.s[start:p.pos]
+		}
+		if err != nil {
+			return "", err
+		}
+
+		key = p.join(key, part)
+		p.skipSpace()
+		if p.peek() != '.' {
+			return key, nil
+		}
+		p.pos++
+		p.skipSpace()
+	}
+}
+
+func isBareKeyByte(c byte) bool {
+	return isNameByte(c) || c == '-'
+}
+
+// value parses a value and adds it to the parser's values under key.
+func (p *tomlParser) value(key string) error {
+	switch p.peek() {
+	case '"', '\'':
+		var s string
+		var err error
+		if p.peek() == '"' {
+			s, err = p.basicString()
+		} else {
+			s, err = p.literalString()
+		}
+		if err != nil {
+			return err
+		}
+		p.add(key, s)
+		return nil
+	case '[':
+		return p.array(key)
+	case '{':
+		return p.inlineTable(key)
+	}
+
+	start := p.pos
+	for !p.eof() && isScalarByte(p.s[p.pos]) {
+		p.pos++
+	}
+	// Dates may separate the date and time with a space
+	if p.pos-start == len("2006-01-02") && p.peek() == ' ' && p.pos+1 < len(p.s) && isDigit(p.s[p.pos+1]) {
+		p.pos++
+		for !p.eof() && isScalarByte(p.s[p.pos]) {
+			p.pos++
+		}
+	}
+
+	s := p.s[start:p.pos]
+	switch {
+	case s == "":
+		return errors.New("expected value")
+	case s == "true", s == "false":
+	case isDigit(s[0]) || s[0] == '+' || s[0] == '-' || s == "inf" || s == "nan":
+		var err error
+		if s, err = tomlNumber(s); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid value %q", s)
+	}
+	p.add(key, s)
+	return nil
+}
+
+// tomlNumber returns the TOML number s with integers in decimal, whether written in decimal, hex (0x), octal (0o), or
+// binary (0b), and floats less any underscores. Dates and times are returned as-is.
+func tomlNumber(s string) (string, error) {
+	if strings.ContainsAny(s, ":T") || (len(s) >= len("2006-01-02") && s[4] == '-') {
+		return s, nil
+	}
+
+	digits, base := strings.Replace(s, "_", "", -1), 10
+	if len(digits) > 2 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x':
+			base = 16
+		case 'o':
+			base = 8
+		case 'b':
+			base = 2
+		}
+	}
+	if base != 10 {
+		digits = digits[2:]
+	} else if strings.ContainsAny(digits, ".eEin") {
+		return digits, nil // A float
+	}
+
+	n, err := strconv.ParseInt(digits, base, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid integer %q", s)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isScalarByte(c byte) bool {
+	return isNameByte(c) || strings.IndexByte("+-.:", c) != -1
+}
+
+func (p *tomlParser) array(key string) error {
+	p.pos++ // [
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.pos++
+			return nil
+		}
+
+		if err := p.value(key); err != nil {
+			return err
+		}
+
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return nil
+		default:
+			return errors.New("expected , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable(key string) error {
+	p.pos++ // {
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.pos++
+		return nil
+	}
+
+	for {
+		p.skipSpace()
+		sub, err := p.key()
+		if err != nil {
+			return err
+		}
+		if p.peek() != '=' {
+			return errors.New("expected = after key")
+		}
+		p.pos++
+		p.skipSpace()
+		if err = p.value(p.join(key, sub)); err != nil {
+			return err
+		}
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return nil
+		default:
+			return errors.New("expected , or } in inline table")
+		}
+	}
+}
+
+// basicString parses a single- or multi-line double-quoted string.
+func (p *tomlParser) basicString() (string, error) {
+	multiline := strings.HasPrefix(p.rest(), `"""`)
+	if multiline {
+		p.pos += 3
+		p.trimLeadingNewline()
+	} else {
+		p.pos++
+	}
+
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", errors.New("unterminated string")
+		}
+
+		switch c := p.s[p.pos]; {
+		case c == '"' && !multiline:
+			p.pos++
+			return b.String(), nil
+		case c == '"' && strings.HasPrefix(p.rest(), `"""`):
+			// Up to two quotes may precede the closing delimiter
+			n := 3
+			for n < 5 && p.pos+n < len(p.s) && p.s[p.pos+n] == '"' {
+				n++
+			}
+			b.WriteString(strings.Repeat(`"`, n-3))
+			p.pos += n
+			return b.String(), nil
+		case c == '\n' && !multiline:
+			return "", errors.New("newline in string")
+		case c == '\\':
+			if err := p.escape(&b, multiline); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// escape parses an escape sequence in a basic string, writing its value to b.
+func (p *tomlParser) escape(b *strings.Builder, multiline bool) error {
+	p.pos++ // \
+	if p.eof() {
+		return errors.New("unterminated string")
+	}
+
+	c := p.s[p.pos]
+	p.pos++
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte('\x1b')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.s) {
+			return errors.New("short unicode escape")
+		}
+		r, err := strconv.ParseUint(p.s[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return fmt.Errorf("invalid unicode escape %q", p.s[p.pos-2:p.pos+n])
+		}
+		b.WriteRune(rune(r))
+		p.pos += n
+	case ' ', '\t', '\r', '\n':
+		// A backslash at the end of a line in a multi-line string trims all whitespace up to the next
+		// non-whitespace character.
+		p.pos--
+		p.skipSpace()
+		if !multiline || !(strings.HasPrefix(p.rest(), "\n") || strings.HasPrefix(p.rest(), "\r\n")) {
+			return errors.New("invalid escape")
+		}
+		for !p.eof() && strings.IndexByte(" \t\r\n", p.s[p.pos]) != -1 {
+			p.pos++
+		}
+	default:
+		return fmt.Errorf("invalid escape %q", `\`+string(c))
+	}
+	return nil
+}
+
+// literalString parses a single- or multi-line single-quoted string.
+func (p *tomlParser) literalString() (string, error) {
+	if strings.HasPrefix(p.rest(), "'''") {
+		p.pos += 3
+		p.trimLeadingNewline()
+		end := strings.Index(p.rest(), "'''")
+		if end == -1 {
+			return "", errors.New("unterminated string")
+		}
+		// Up to two quotes may precede the closing delimiter
+		for n := 0; n < 2 && p.pos+end+3 < len(p.s) && p.s[p.pos+end+3] == '\''; n++ {
+			end++
+		}
+		s := p.s[p.pos : p.pos+end]
+		p.pos += end + 3
+		return s, nil
+	}
+
+	p.pos++
+	end := strings.IndexAny(p.rest(), "'\n")
+	if end == -1 || p.s[p.pos+end] != '\'' {
+		return "", errors.New("unterminated string")
+	}
+	s := p.s[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+func (p *tomlParser) trimLeadingNewline() {
+	if strings.HasPrefix(p.rest(), "\r\n") {
+		p.pos += 2
+	} else if p.peek() == '\n' {
+		p.pos++
+	}
+}
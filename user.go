@@ -0,0 +1,105 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credential is the user and groups to run a command as.
+type credential = syscall.Credential
+
+// lookupCredential returns the credential to run a command with as userName and groupName, either of which may be
+// a name or a numeric ID. If userName is empty, the current user ID is kept. The group ID is that of groupName if
+// given, or otherwise the primary group of userName. Supplementary groups are those of userName, if it has any.
+//
+// As with Docker, a numeric user ID without a passwd entry has a primary group ID of 0 unless groupName is given.
+func lookupCredential(userName, groupName string) (*credential, error) {
+	cred := &credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, ok := err.(user.UnknownUserError); ok {
+			if _, perr := strconv.ParseUint(userName, 10, 32); perr == nil {
+				u, err = user.LookupId(userName)
+			}
+		}
+
+		switch err.(type) {
+		case nil:
+			if cred.Uid, err = parseID(u.Uid); err != nil {
+				return nil, err
+			}
+			if cred.Gid, err = parseID(u.Gid); err != nil {
+				return nil, err
+			}
+			gids, err := u.GroupIds()
+			if err != nil {
+				return nil, fmt.Errorf("error looking up groups of user %q: %v", userName, err)
+			}
+			for _, gid := range gids {
+				id, err := parseID(gid)
+				if err != nil {
+					return nil, err
+				}
+				cred.Groups = append(cred.Groups, id)
+			}
+		case user.UnknownUserIdError:
+			cred.Uid, _ = parseID(userName)
+			cred.Gid = 0
+		default:
+			return nil, err
+		}
+	}
+
+	if groupName != "" {
+		id, err := parseID(groupName)
+		if err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return nil, err
+			}
+			if id, err = parseID(g.Gid); err != nil {
+				return nil, err
+			}
+		}
+		cred.Gid = id
+	}
+
+	return cred, nil
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %q", id)
+	}
+	return uint32(n), nil
+}
+
+// setCredential sets the supplementary groups, group ID, and user ID of the process to those of cred, in that order,
+// since the group IDs can't be changed once privileges are dropped.
+func setCredential(cred *credential) error {
+	groups := make([]int, len(cred.Groups))
+	for i, gid := range cred.Groups {
+		groups[i] = int(gid)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package main
+
+// credential is the user and groups to run a command as. Commands can't be run as another user on Windows.
+type credential struct{}
+
+// lookupCredential always fails, since commands can't be run as another user.
+func lookupCredential(userName, groupName string) (*credential, error) {
+	return nil, errUnsupported
+}
+
+// setCredential always fails, since commands can't be run as another user.
+func setCredential(cred *credential) error {
+	return errUnsupported
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// missingRequired returns the names in required that don't have a non-empty value in src. A name containing wildcards
+// is satisfied by any matching key with a non-empty value.
+func missingRequired(src map[string][]string, required []string, j *joiner) []string {
+	var missing []string
+	for _, name := range required {
+		pat := compilePattern(name, "requirement")
+		found := false
+		if pat.literal() {
+			key := lookupKey(name)
+			found = j.join(key, src[key]) != ""
+		} else {
+			for k, v := range src {
+				if pat.match(k) && j.join(k, v) != "" {
+					found = true
+					break
+				}
+			}
+		}
+
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// nulVars returns a description of each NUL byte in the keys and values of vars, naming its variable and giving its
+// byte offset. The OS would silently truncate such keys and values at the NUL.
+func nulVars(vars []envVar) []string {
+	var found []string
+	for _, v := range vars {
+		if i := strings.IndexByte(v.key, 0); i != -1 {
+			found = append(found, fmt.Sprintf("%q: NUL byte in name at offset %d", v.key, i))
+		}
+		if i := strings.IndexByte(v.value, 0); i != -1 {
+			found = append(found, fmt.Sprintf("%s: NUL byte in value at offset %d", v.key, i))
+		}
+	}
+	return found
+}
+
+// isPOSIXName returns whether name is a valid POSIX environment variable name, matching ^[A-Za-z_][A-Za-z0-9_]*$.
+func isPOSIXName(name string) bool {
+	if name == "" || !isNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isNameByte(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// posixVars returns the vars whose keys are valid POSIX names, and the keys of those that aren't.
+func posixVars(vars []envVar) (valid []envVar, invalid []string) {
+	valid = vars[:0]
+	for _, v := range vars {
+		if isPOSIXName(v.key) {
+			valid = append(valid, v)
+		} else {
+			invalid = append(invalid, v.key)
+		}
+	}
+	return valid, invalid
+}
+
+// Checks is a flag.Value for patterns that the values of keys matching specific patterns must match, given as
+// KEY=REGEX.
+type Checks []valueCheck
+
+type valueCheck struct {
+	pat keyPattern
+	re  *regexp.Regexp
+}
+
+func (c *Checks) String() string {
+	return "[]"
+}
+
+func (c *Checks) Set(str string) error {
+	idx := strings.IndexByte(str, '=')
+	if idx == -1 {
+		return fmt.Errorf("expected KEY=REGEX, got %q", str)
+	}
+
+	// The pattern must match the whole value
+	re, err := regexp.Compile(`^(?:` + str[idx+1:] + `)$`)
+	if err != nil {
+		return err
+	}
+
+	*c = append(*c, valueCheck{
+		pat: compilePattern(str[:idx], "check key"),
+		re:  re,
+	})
+	return nil
+}
+
+// checkValues returns the names of checks that match no key in src, and the keys whose values, joined by j, don't
+// match the pattern of a check.
+func checkValues(src map[string][]string, checks Checks, j *joiner) (unset, invalid []string) {
+	for _, c := range checks {
+		found := false
+		for k, v := range src {
+			if !c.pat.match(k) {
+				continue
+			}
+			found = true
+			if !c.re.MatchString(j.join(k, v)) {
+				invalid = append(invalid, k)
+			}
+		}
+
+		if !found {
+			unset = append(unset, c.pat.name)
+		}
+	}
+	sort.Strings(invalid)
+	return unset, invalid
+}
+
+// readSchema returns the keys of the INI file at path as patterns, for use with unknownKeys. The file is read as any INI
+// file is, but its values and any [binit] section are ignored.
+func readSchema(path string, dec *configReader) ([]keyPattern, error) {
+	b, err := dec.readInput(path)
+	if err == nil {
+		b, err = gunzip(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := fileValues{values: map[string][]string{}, casing: dec.casing, settingsSep: dec.Separator}
+	if err := dec.Read(bytes.NewReader(b), &values); err != nil {
+		return nil, err
+	}
+
+	schema := make([]keyPattern, len(values.keys))
+	for i, k := range values.keys {
+		schema[i] = compilePattern(k, "schema key")
+	}
+	return schema, nil
+}
+
+// unknownKeys returns the keys of src that match no pattern of schema, sorted. Keys set in env are never unknown, so
+// that inherited variables needn't be listed in a schema.
+func unknownKeys(src map[string][]string, schema []keyPattern, env map[string]string) []string {
+	var unknown []string
+	for k := range src {
+		if _, ok := env[k]; ok {
+			continue
+		}
+
+		known := false
+		for _, pat := range schema {
+			if known = pat.match(k); known {
+				break
+			}
+		}
+		if !known {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
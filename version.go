@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// Build metadata, set at link time with -ldflags, e.g.:
+//
+//	go build -ldflags "-X main.version=v0.2.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// writeVersion writes binit's version and build metadata to w.
+func writeVersion(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "binit %s\n", version)
+	if err == nil && commit != "" {
+		_, err = fmt.Fprintf(w, "commit: %s\n", commit)
+	}
+	if err == nil && buildDate != "" {
+		_, err = fmt.Fprintf(w, "built: %s\n", buildDate)
+	}
+	if err == nil {
+		_, err = fmt.Fprintf(w, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	}
+	return err
+}
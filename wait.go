@@ -0,0 +1,224 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// defaultForwardedSignals are the signals relayed to a command started by run if -g isn't given.
+var defaultForwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGTERM,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// run starts the command at path with argv and env, connected to binit's standard input, output, and error, and waits
+// for it to exit. The command is started in its own process group, which is made the foreground process group if
+// standard input is a terminal. Signals in forward received by binit while the command runs are relayed to the
+// command's process group.
+//
+// The returned status is the command's exit status, or 128 plus the signal number if the command was killed by
+// a signal. If the command exceeded its timeout, the status is exitTimeout.
+func run(path string, argv, env []string, opts runOptions) (int, error) {
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   argv,
+		Env:    env,
+		Dir:    opts.dir,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Setpgid:    true,
+			Credential: opts.cred,
+		},
+	}
+
+	// A session leader is also the leader of a new process group, so signals are relayed to it the same way
+	if opts.setsid {
+		cmd.SysProcAttr.Setpgid = false
+		cmd.SysProcAttr.Setsid = true
+	} else if fd := int(os.Stdin.Fd()); isForegroundTerminal(fd) {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = fd
+	}
+
+	sigs := make(chan os.Signal, len(opts.forward)+1)
+	if len(opts.forward) > 0 { // Notify with no signals relays all signals
+		signal.Notify(sigs, opts.forward...)
+	}
+	defer func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}()
+
+	// Subscribe to SIGCHLD before starting the command so that its exit can't be missed
+	var sigchld chan os.Signal
+	if opts.reap {
+		sigchld = make(chan os.Signal, 1)
+		signal.Notify(sigchld, syscall.SIGCHLD)
+		defer signal.Stop(sigchld)
+	}
+
+	// Output that's copied goes through pipes, rather than letting exec copy it, so that it's fully copied even when
+	// the command is reaped instead of waited on
+	var pipes []*os.File
+	var copying []<-chan struct{}
+	closePipes := func() {
+		for _, pw := range pipes {
+			pw.Close()
+		}
+	}
+	for _, p := range []struct {
+		w   io.Writer
+		dst *io.Writer
+	}{{opts.stdout, &cmd.Stdout}, {opts.stderr, &cmd.Stderr}} {
+		if p.w == nil {
+			continue
+		}
+		pw, done, err := pipeTo(p.w)
+		if err != nil {
+			closePipes()
+			return 0, err
+		}
+		*p.dst = pw
+		pipes = append(pipes, pw)
+		copying = append(copying, done)
+	}
+
+	err := cmd.Start()
+	// Only the command holds the write ends of the pipes once it's started, so they reach EOF once it and any children
+	// it passed them to exit
+	closePipes()
+	if err != nil {
+		return 0, err
+	}
+
+	pgid := cmd.Process.Pid
+	go func() {
+		for sig := range sigs {
+			_ = syscall.Kill(-pgid, sig.(syscall.Signal))
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	var expired int32
+	if opts.timeout > 0 {
+		go func() {
+			select {
+			case <-done:
+				return
+			case <-time.After(opts.timeout):
+			}
+			atomic.StoreInt32(&expired, 1)
+			log("command timed out after ", opts.timeout, ", sending TERM")
+			_ = syscall.Kill(-pgid, syscall.SIGTERM)
+
+			select {
+			case <-done:
+				return
+			case <-time.After(opts.grace):
+			}
+			log("command still running after ", opts.grace, ", sending KILL")
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		}()
+	}
+
+	var status int
+	if opts.reap {
+		status, err = reap(cmd.Process.Pid, sigchld)
+	} else {
+		status, err = wait(cmd)
+	}
+	if err == nil && atomic.LoadInt32(&expired) == 1 {
+		status = exitTimeout
+	}
+	for _, done := range copying {
+		<-done
+	}
+	return status, err
+}
+
+// wait waits for cmd to exit and returns its exit status.
+func wait(cmd *exec.Cmd) (int, error) {
+	if err := cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return 0, err
+		}
+	}
+	return exitStatus(cmd.ProcessState.Sys().(syscall.WaitStatus)), nil
+}
+
+// reap waits for any child process to exit, each time sigchld receives a signal, until the process pid exits. It
+// returns the exit status of pid.
+func reap(pid int, sigchld <-chan os.Signal) (int, error) {
+	for {
+		for {
+			var ws syscall.WaitStatus
+			wpid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+			if err == syscall.EINTR {
+				continue
+			} else if err != nil {
+				return 0, err
+			} else if wpid <= 0 {
+				break
+			}
+
+			if wpid == pid {
+				return exitStatus(ws), nil
+			}
+		}
+		<-sigchld
+	}
+}
+
+func exitStatus(ws syscall.WaitStatus) int {
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
+
+// newSession starts a new session led by binit, detached from any controlling terminal.
+func newSession() error {
+	_, err := syscall.Setsid()
+	return err
+}
+
+// isForegroundTerminal returns whether fd is a terminal whose foreground process group is binit's.
+func isForegroundTerminal(fd int) bool {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	return errno == 0 && int(pgrp) == syscall.Getpgrp()
+}
@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errUnsupported is returned by features that depend on Unix processes, signals, or users.
+var errUnsupported = errors.New("not supported on windows")
+
+// defaultForwardedSignals are the signals relayed to a command started by run if -g isn't given.
+var defaultForwardedSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+}
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+}
+
+// run always fails, since commands are supervised through Unix process groups and signals.
+func run(path string, argv, env []string, opts runOptions) (int, error) {
+	return 0, errUnsupported
+}
+
+// newSession always fails, since there are no sessions to start.
+func newSession() error {
+	return errUnsupported
+}